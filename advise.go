@@ -0,0 +1,268 @@
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// a source of mail for a domain, i.e. a known sender or the organization of its hosts' names
+type mailSource struct {
+	Name     string
+	Status   string
+	Messages int64
+	Passing  int64
+}
+
+func (s *mailSource) passRate() float64 {
+	if s.Messages == 0 {
+		return 0
+	}
+	return float64(s.Passing) / float64(s.Messages)
+}
+
+// whether a source is ours, either authorized in the sender rules or, unclassified, mostly passing DMARC
+func (s *mailSource) legitimate() bool {
+	switch s.Status {
+	case "authorized":
+		return true
+	case "unclassified":
+		return s.passRate() >= viper.GetFloat64("adviseLegitPassRate")
+	}
+	return false
+}
+
+// a policy a domain could publish on its way to enforcement
+type policyStep struct {
+	P   string
+	PCT int
+}
+
+func (step policyStep) String() string {
+	return fmt.Sprintf("p=%s pct=%d", step.P, step.PCT)
+}
+
+// the steps from p=none to p=reject, i.e. quarantine at 10, 25, 50 and 100 percent, then reject at each
+func policySteps() []policyStep {
+	steps := []policyStep{{"none", 100}}
+	for _, p := range []string{"quarantine", "reject"} {
+		for _, pct := range viper.GetStringSlice("advisePctSteps") {
+			if n, err := strconv.Atoi(pct); err == nil {
+				steps = append(steps, policyStep{p, n})
+			}
+		}
+	}
+	return steps
+}
+
+// handles `dmarcdb advise <domain> [--since 30d]`, recommending the next policy a domain can safely publish
+func advise(args ...string) error {
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+		return fmt.Errorf("Usage: dmarcdb advise <domain> [--since 30d]")
+	}
+	var (
+		domain = args[0]
+		flags  = flag.NewFlagSet("advise", flag.ContinueOnError)
+		since  = flags.String("since", "30d", "look at records reported since, i.e. 30d or 2018-01-31")
+	)
+	if err := flags.Parse(args[1:]); err != nil {
+		return err
+	}
+	sinceTime, err := parseSince(*since)
+	if err != nil {
+		return err
+	}
+
+	sources, err := loadSources(domain, sinceTime)
+	if err != nil {
+		return err
+	}
+	if len(sources) == 0 {
+		return fmt.Errorf("No records for %s since %s", domain, sinceTime.Format("2006-01-02"))
+	}
+	current, err := currentPolicy(domain)
+	if err != nil {
+		return err
+	}
+
+	var (
+		total, passing, legitMessages int64
+		legit                         []*mailSource
+	)
+	for _, s := range sources {
+		total += s.Messages
+		passing += s.Passing
+		if s.legitimate() {
+			legit = append(legit, s)
+			legitMessages += s.Messages
+		}
+	}
+	sort.Slice(legit, func(i, j int) bool {
+		return legit[i].Messages-legit[i].Passing > legit[j].Messages-legit[j].Passing
+	})
+
+	fmt.Printf("%s: %d messages since %s, %.1f%% passing DMARC, %d of them from %d legitimate sources\n",
+		domain, total, sinceTime.Format("2006-01-02"), percent(passing, total), legitMessages, len(legit))
+	fmt.Printf("Published policy: %s\n\n", current)
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "LEGITIMATE SOURCE\tSTATUS\tMESSAGES\tPASS RATE\tFAILING")
+	for _, s := range legit {
+		fmt.Fprintf(w, "%s\t%s\t%d\t%.1f%%\t%d\n", s.Name, s.Status, s.Messages, 100*s.passRate(), s.Messages-s.Passing)
+	}
+	if err = w.Flush(); err != nil {
+		return err
+	}
+
+	// what each step past the current policy would do to legitimate mail which fails DMARC
+	var (
+		threshold = viper.GetFloat64("adviseThreshold")
+		steps     = policySteps()
+		next      *policyStep
+		nextShare float64
+		blockers  []string
+	)
+	fmt.Println()
+	fmt.Fprintln(w, "AT POLICY\tLEGITIMATE MESSAGES AFFECTED\tSHARE\tSOURCES AFFECTED")
+	for i, step := range steps {
+		if i <= stepIndex(steps, current) {
+			continue
+		}
+		affected, names := affectedBy(step, legit)
+		share := percent(affected, legitMessages)
+		fmt.Fprintf(w, "%s\t%d\t%.2f%%\t%s\n", step, affected, share, strings.Join(names, ", "))
+		// only the next step is recommended, so each is watched for a while before going further
+		if i == stepIndex(steps, current)+1 {
+			blockers = names
+			if share <= 100*threshold {
+				next, nextShare = &steps[i], share
+			}
+		}
+	}
+	if err = w.Flush(); err != nil {
+		return err
+	}
+
+	fmt.Println()
+	switch {
+	case stepIndex(steps, current) == len(steps)-1:
+		fmt.Printf("Recommendation: %s is already fully enforced\n", domain)
+	case next != nil:
+		fmt.Printf("Recommendation: publish %s, affecting %.2f%% of legitimate mail (threshold %.2f%%)\n", *next, nextShare, 100*threshold)
+	default:
+		fmt.Printf("Recommendation: stay at %s until these legitimate sources pass DMARC: %s\n", current, strings.Join(blockers, ", "))
+	}
+	return nil
+}
+
+// loads each source of a domain's mail since a time, with how much of it passed DMARC
+func loadSources(domain string, since time.Time) (map[string]*mailSource, error) {
+	cols := []string{"sender", "hostname", "source_ip"}
+	query := fmt.Sprintf("SELECT %s, SUM(count), SUM(CASE WHEN %s THEN count ELSE 0 END) FROM records WHERE %s = $1 AND date_range_begin >= $2 GROUP BY %s",
+		selectGrouped(cols...), evaluatedPass(), textCol("domain"), groupBy(cols...))
+	rows, err := db.Query(rebind(query), domain, since.Unix())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sources := map[string]*mailSource{}
+	for rows.Next() {
+		var (
+			sender, hostname, ip sql.NullString
+			messages, passing    sql.NullInt64
+		)
+		if err = rows.Scan(&sender, &hostname, &ip, &messages, &passing); err != nil {
+			return nil, err
+		}
+
+		name, status := sourceOf(sender.String, hostname.String, ip.String)
+		s, ok := sources[name]
+		if !ok {
+			s = &mailSource{Name: name, Status: status}
+			sources[name] = s
+		}
+		s.Messages += messages.Int64
+		s.Passing += passing.Int64
+	}
+	return sources, rows.Err()
+}
+
+// names the source of a record, by its known sender, else the organization of its hostname, else its IP
+func sourceOf(sender, hostname, ip string) (string, string) {
+	if i := strings.LastIndex(sender, " ("); i > 0 && strings.HasSuffix(sender, ")") {
+		return sender[:i], sender[i+2 : len(sender)-1]
+	}
+	if host := strings.Split(hostname, ",")[0]; host != "" {
+		return orgDomain(host), "unclassified"
+	}
+	return ip, "unclassified"
+}
+
+// the policy a domain publishes, from its latest DNS snapshot or else its latest report
+func currentPolicy(domain string) (policyStep, error) {
+	snaps, err := snapshotsAt(domain, time.Now().Unix(), 1)
+	if err != nil {
+		return policyStep{}, err
+	}
+	if len(snaps) > 0 {
+		return policyStep{snaps[0].Policy.P, snaps[0].Policy.PCT}, nil
+	}
+
+	var step policyStep
+	query := limit(fmt.Sprintf("SELECT %s, pct FROM records WHERE %s = $1 ORDER BY date_range_end DESC", textCol("p"), textCol("domain")), 1)
+	err = db.QueryRow(rebind(query), domain).Scan(&step.P, &step.PCT)
+	return step, err
+}
+
+// finds where a policy falls on the steps to enforcement, rounding down to the step below it
+func stepIndex(steps []policyStep, policy policyStep) int {
+	idx := 0
+	for i, step := range steps {
+		if (step.P == policy.P && step.PCT <= policy.PCT) || (policy.P == "reject" && step.P == "quarantine") {
+			idx = i
+		}
+	}
+	return idx
+}
+
+// estimates how many legitimate messages a step would quarantine or reject, and from which sources. At p=reject
+// every failing message is affected whatever pct is, since the rest are quarantined rather than rejected
+func affectedBy(step policyStep, legit []*mailSource) (int64, []string) {
+	var (
+		affected int64
+		names    []string
+		share    = float64(step.PCT) / 100
+	)
+	switch step.P {
+	case "none":
+		return 0, nil
+	case "reject":
+		share = 1
+	}
+	for _, s := range legit {
+		if failing := s.Messages - s.Passing; failing > 0 {
+			// rounded up, so a small source isn't estimated as unaffected
+			n := int64(math.Ceil(float64(failing) * share))
+			affected += n
+			names = append(names, fmt.Sprintf("%s (%d)", s.Name, n))
+		}
+	}
+	return affected, names
+}
+
+func percent(n, total int64) float64 {
+	if total == 0 {
+		return 0
+	}
+	return 100 * float64(n) / float64(total)
+}
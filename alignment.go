@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"golang.org/x/net/publicsuffix"
+)
+
+// how a record's DKIM or SPF result lines up with its header_from domain, from strongest to weakest
+const (
+	// passed for exactly the header_from domain, aligned even under adkim=s / aspf=s
+	alignedStrict = "strict"
+	// passed for another domain of the same organization, only aligned under adkim=r / aspf=r
+	alignedRelaxed = "relaxed"
+	// passed for an unrelated domain, so it doesn't count towards DMARC
+	unaligned = "unaligned"
+	// didn't pass at all
+	alignmentFail = "fail"
+)
+
+// returns the organizational domain of a domain (RFC 7489 section 3.2), i.e. "mail.wvu.edu" is "wvu.edu"
+func orgDomain(domain string) string {
+	domain = strings.TrimSuffix(strings.ToLower(strings.TrimSpace(domain)), ".")
+	if org, err := publicsuffix.EffectiveTLDPlusOne(domain); err == nil {
+		return org
+	}
+	return domain
+}
+
+// classifies an authentication result for authDomain against the header_from domain
+func alignment(result, authDomain, fromDomain string) string {
+	authDomain = strings.TrimSuffix(strings.ToLower(strings.TrimSpace(authDomain)), ".")
+	fromDomain = strings.TrimSuffix(strings.ToLower(strings.TrimSpace(fromDomain)), ".")
+	switch {
+	case !strings.EqualFold(result, "pass"):
+		return alignmentFail
+	case authDomain == fromDomain:
+		return alignedStrict
+	case authDomain != "" && orgDomain(authDomain) == orgDomain(fromDomain):
+		return alignedRelaxed
+	default:
+		return unaligned
+	}
+}
+
+// how strongly each alignment counts, to pick the best of several
+var alignmentRank = map[string]int{alignedStrict: 3, alignedRelaxed: 2, unaligned: 1, alignmentFail: 0}
+
+// returns the DKIM signature which aligns best with the header_from domain and its alignment, since the record
+// passes DKIM if any passing signature aligns, or false if there are none
+func bestDKIM(sigs []DKIMAuthResult, from string) (DKIMAuthResult, string, bool) {
+	var (
+		best    DKIMAuthResult
+		aligned string
+	)
+	for i, sig := range sigs {
+		if a := alignment(sig.Result, sig.Domain, from); i == 0 || alignmentRank[a] > alignmentRank[aligned] {
+			best, aligned = sig, a
+		}
+	}
+	return best, aligned, len(sigs) > 0
+}
+
+// alignmentEnricher classifies whether a record's DKIM and SPF passes were aligned with its header_from domain,
+// and notes the organizational domain the header_from domain belongs to
+type alignmentEnricher struct{}
+
+func (alignmentEnricher) Name() string { return "alignment" }
+
+func (alignmentEnricher) Network() bool { return false }
+
+func (alignmentEnricher) Enrich(ctx context.Context, report *DMARCFeedback, record DMARCRecord, attrs Attributes) (Attributes, error) {
+	from := fromDomain(report, record)
+	if from == "" || from == "null" {
+		return nil, fmt.Errorf("record from %s has no header_from domain", record.SourceIP)
+	}
+	dkim := alignment(record.DKIMResult, record.DKIMDomain, from)
+	// a stored record (i.e. re-enriched) only has the signature which aligned best
+	if _, aligned, ok := bestDKIM(record.DKIMResults, from); ok {
+		dkim = aligned
+	}
+	return Attributes{
+		"dkim_alignment": dkim,
+		"spf_alignment":  alignment(record.SPFResult, record.SPFDomain, from),
+		"org_domain":     orgDomain(from),
+	}, nil
+}
+
+// SQL conditions on the stored alignments, for whether a record passes DMARC under its published adkim/aspf,
+// or would with either tightened to strict
+const passesStrict = "(dkim_alignment = 'strict' OR spf_alignment = 'strict')"
+
+func alignedNow(mechanism, mode string) string {
+	return fmt.Sprintf("(%[1]s_alignment = 'strict' OR (%[1]s_alignment = 'relaxed' AND COALESCE(%[2]s, 'r') <> 's'))", mechanism, textCol(mode))
+}
+
+func passesNow() string {
+	return fmt.Sprintf("(%s OR %s)", alignedNow("dkim", "adkim"), alignedNow("spf", "aspf"))
+}
+
+func passesStrictDKIM() string {
+	return fmt.Sprintf("(dkim_alignment = 'strict' OR %s)", alignedNow("spf", "aspf"))
+}
+
+func passesStrictSPF() string {
+	return fmt.Sprintf("(%s OR spf_alignment = 'strict')", alignedNow("dkim", "adkim"))
+}
+
+// sums the messages of records which pass DMARC now, but wouldn't once tightened
+func breaksWhen(tightened string) string {
+	return fmt.Sprintf("SUM(CASE WHEN %s AND NOT %s THEN count ELSE 0 END)", passesNow(), tightened)
+}
@@ -0,0 +1,30 @@
+package main
+
+import "testing"
+
+func TestBestDKIM(t *testing.T) {
+	var (
+		strict    = DKIMAuthResult{Domain: "wvu.edu", Result: "pass"}
+		relaxed   = DKIMAuthResult{Domain: "mail.wvu.edu", Result: "pass"}
+		unrelated = DKIMAuthResult{Domain: "mcsv.net", Result: "pass"}
+		failed    = DKIMAuthResult{Domain: "wvu.edu", Result: "fail"}
+	)
+	tests := []struct {
+		name    string
+		sigs    []DKIMAuthResult
+		best    DKIMAuthResult
+		aligned string
+	}{
+		{"none", nil, DKIMAuthResult{}, ""},
+		{"only failing", []DKIMAuthResult{failed}, failed, alignmentFail},
+		{"failing then relaxed", []DKIMAuthResult{failed, relaxed}, relaxed, alignedRelaxed},
+		{"third party then strict", []DKIMAuthResult{unrelated, relaxed, strict}, strict, alignedStrict},
+		{"third party only", []DKIMAuthResult{failed, unrelated}, unrelated, unaligned},
+	}
+	for _, tt := range tests {
+		best, aligned, ok := bestDKIM(tt.sigs, "wvu.edu")
+		if best != tt.best || aligned != tt.aligned || ok != (len(tt.sigs) > 0) {
+			t.Errorf("%s: bestDKIM = %+v, %q, %v, want %+v, %q", tt.name, best, aligned, ok, tt.best, tt.aligned)
+		}
+	}
+}
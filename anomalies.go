@@ -0,0 +1,237 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+const day = 24 * time.Hour
+
+// messages reported on a UTC day for a domain, source ASN, known sender and disposition, and whether they passed DMARC
+type dailyCount struct {
+	Day         time.Time `json:"day"`
+	Domain      string    `json:"domain"`
+	ASN         int64     `json:"asn"`
+	Sender      string    `json:"sender"`
+	Disposition string    `json:"disposition"`
+	Passing     bool      `json:"passing"`
+	Messages    float64   `json:"messages"`
+}
+
+// spreads a report's count over the UTC days its date range covers, in proportion to the time in each,
+// since reporters send anything from hourly to weekly reports
+func spreadDays(begin, end int64, count float64) map[time.Time]float64 {
+	if end <= begin {
+		return map[time.Time]float64{time.Unix(begin, 0).UTC().Truncate(day): count}
+	}
+	var (
+		days  = map[time.Time]float64{}
+		total = float64(end - begin)
+	)
+	for t := begin; t < end; {
+		start := time.Unix(t, 0).UTC().Truncate(day)
+		next := start.Add(day).Unix()
+		if next > end {
+			next = end
+		}
+		days[start] += count * float64(next-t) / total
+		t = next
+	}
+	return days
+}
+
+// loads the daily message counts since a time from the daily rollup
+func loadDaily(since time.Time, domain string) ([]dailyCount, error) {
+	var (
+		cols   = []string{"domain", "sender", "disposition"}
+		conds  = "day >= $1"
+		params = []interface{}{since.UTC().Truncate(day).Unix()}
+		pass   = fmt.Sprintf("CASE WHEN %s THEN 1 ELSE 0 END", evaluatedPass())
+	)
+	if domain != "" {
+		conds += " AND " + textCol("domain") + " = $2"
+		params = append(params, domain)
+	}
+	query := fmt.Sprintf("SELECT day, %s, asn, %s, SUM(messages) FROM daily_rollup WHERE %s GROUP BY day, %s, asn, %s ORDER BY day",
+		selectGrouped(cols...), pass, conds, groupBy(cols...), pass)
+	rows, err := db.Query(rebind(query), params...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var counts []dailyCount
+	for rows.Next() {
+		var (
+			c                        dailyCount
+			d                        int64
+			dom, sender, disposition sql.NullString
+			asn                      sql.NullInt64
+			passing                  int
+		)
+		if err = rows.Scan(&d, &dom, &sender, &disposition, &asn, &passing, &c.Messages); err != nil {
+			return nil, err
+		}
+		c.Day, c.Domain, c.ASN, c.Sender, c.Disposition, c.Passing = time.Unix(d, 0).UTC(), dom.String, asn.Int64, sender.String, disposition.String, passing == 1
+		counts = append(counts, c)
+	}
+	return counts, rows.Err()
+}
+
+// a day whose volume was far from what's usual for that weekday
+type anomaly struct {
+	Day      time.Time `json:"day"`
+	Kind     string    `json:"kind"`
+	Domain   string    `json:"domain"`
+	Source   string    `json:"source"`
+	Messages float64   `json:"messages"`
+	Baseline float64   `json:"baseline"`
+	Z        float64   `json:"z"`
+}
+
+// flags spikes in failing volume per domain and source ASN, and drops in passing volume per domain and known sender,
+// on each of the days checked. Each day is compared with the same weekday over the anomalyBaselineWeeks before it,
+// so weekly cycles (i.e. quiet weekends) aren't flagged
+func detectAnomalies(counts []dailyCount, days []time.Time) []anomaly {
+	type key struct {
+		kind, domain, source string
+	}
+	series := map[key]map[time.Time]float64{}
+	add := func(k key, d time.Time, n float64) {
+		if series[k] == nil {
+			series[k] = map[time.Time]float64{}
+		}
+		series[k][d] += n
+	}
+	for _, c := range counts {
+		switch {
+		case !c.Passing:
+			source := "unknown ASN"
+			if c.ASN > 0 {
+				source = fmt.Sprintf("AS%d", c.ASN)
+			}
+			add(key{"failing-spike", c.Domain, source}, c.Day, c.Messages)
+		case c.Sender != "":
+			add(key{"passing-drop", c.Domain, c.Sender}, c.Day, c.Messages)
+		}
+	}
+
+	var (
+		weeks       = viper.GetInt("anomalyBaselineWeeks")
+		threshold   = viper.GetFloat64("anomalyZ")
+		minMessages = viper.GetFloat64("anomalyMinMessages")
+		anomalies   []anomaly
+	)
+	for k, s := range series {
+		for _, d := range days {
+			var baseline []float64
+			for w := 1; w <= weeks; w++ {
+				baseline = append(baseline, s[d.AddDate(0, 0, -7*w)])
+			}
+			mean, stddev := meanStddev(baseline)
+			// a floor on the deviation, so a sender which always sends exactly the same isn't flagged for one message
+			stddev = math.Max(stddev, math.Sqrt(mean))
+			if stddev == 0 {
+				stddev = 1
+			}
+
+			n := s[d]
+			z := (n - mean) / stddev
+			switch {
+			case k.kind == "failing-spike" && z >= threshold && n >= minMessages:
+			case k.kind == "passing-drop" && z <= -threshold && mean >= minMessages:
+			default:
+				continue
+			}
+			anomalies = append(anomalies, anomaly{d, k.kind, k.domain, k.source, n, mean, z})
+		}
+	}
+	sort.Slice(anomalies, func(i, j int) bool {
+		if !anomalies[i].Day.Equal(anomalies[j].Day) {
+			return anomalies[i].Day.After(anomalies[j].Day)
+		}
+		return math.Abs(anomalies[i].Z) > math.Abs(anomalies[j].Z)
+	})
+	return anomalies
+}
+
+func meanStddev(vals []float64) (float64, float64) {
+	if len(vals) == 0 {
+		return 0, 0
+	}
+	var sum, sq float64
+	for _, v := range vals {
+		sum += v
+	}
+	mean := sum / float64(len(vals))
+	for _, v := range vals {
+		sq += (v - mean) * (v - mean)
+	}
+	return mean, math.Sqrt(sq / float64(len(vals)))
+}
+
+// the last days before yesterday (whose reports are still arriving), oldest first
+func checkedDays(now time.Time, last int) ([]time.Time, error) {
+	var (
+		today = now.UTC().Truncate(day)
+		days  []time.Time
+	)
+	for i := last + 1; i > 1; i-- {
+		days = append(days, today.AddDate(0, 0, -i))
+	}
+	if len(days) == 0 {
+		return nil, fmt.Errorf("--days must be at least 1")
+	}
+	return days, nil
+}
+
+// handles `dmarcdb anomalies [--days 7] [--domain wvu.edu] [--json] [--alert]`, flagging unusual daily volumes
+func anomalies(args ...string) error {
+	var (
+		flags  = flag.NewFlagSet("anomalies", flag.ContinueOnError)
+		last   = flags.Int("days", 7, "check each of the last days, before yesterday whose reports are still arriving")
+		domain = flags.String("domain", "", "only check this domain")
+		asJSON = flags.Bool("json", false, "print each anomaly as JSON")
+		alert  = flags.Bool("alert", false, "exit with an error if any anomaly is found, i.e. from a scheduled task")
+	)
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	days, err := checkedDays(time.Now(), *last)
+	if err != nil {
+		return err
+	}
+
+	counts, err := loadDaily(days[0].AddDate(0, 0, -7*viper.GetInt("anomalyBaselineWeeks")), *domain)
+	if err != nil {
+		return err
+	}
+	found := detectAnomalies(counts, days)
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(found)
+	} else {
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "DAY\tKIND\tDOMAIN\tSOURCE\tMESSAGES\tBASELINE\tZ")
+		for _, a := range found {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%.0f\t%.0f\t%.1f\n", a.Day.Format("2006-01-02"), a.Kind, a.Domain, a.Source, a.Messages, a.Baseline, a.Z)
+		}
+		err = w.Flush()
+	}
+	if err == nil && *alert && len(found) > 0 {
+		err = fmt.Errorf("%d anomalies found", len(found))
+	}
+	return err
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+func TestSpreadDays(t *testing.T) {
+	var (
+		jan1 = time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+		jan2 = jan1.Add(day)
+		jan3 = jan2.Add(day)
+		at   = func(d time.Time, hours int) int64 { return d.Add(time.Duration(hours) * time.Hour).Unix() }
+	)
+	tests := []struct {
+		name       string
+		begin, end int64
+		count      float64
+		want       map[time.Time]float64
+	}{
+		{"zero length", at(jan1, 6), at(jan1, 6), 10, map[time.Time]float64{jan1: 10}},
+		{"reversed", at(jan2, 6), at(jan1, 6), 10, map[time.Time]float64{jan2: 10}},
+		{"within a day", at(jan1, 1), at(jan1, 5), 10, map[time.Time]float64{jan1: 10}},
+		{"whole day", at(jan1, 0), at(jan2, 0), 10, map[time.Time]float64{jan1: 10}},
+		{"across midnight", at(jan1, 22), at(jan2, 2), 10, map[time.Time]float64{jan1: 5, jan2: 5}},
+		{"uneven across midnight", at(jan1, 18), at(jan2, 0) + 2*3600, 8, map[time.Time]float64{jan1: 6, jan2: 2}},
+		{"two days", at(jan1, 0), at(jan3, 0), 1000, map[time.Time]float64{jan1: 500, jan2: 500}},
+		{"weekly into a partial day", at(jan1, 12), at(jan3, 12), 4, map[time.Time]float64{jan1: 1, jan2: 2, jan3: 1}},
+	}
+	for _, tt := range tests {
+		got := spreadDays(tt.begin, tt.end, tt.count)
+		if len(got) != len(tt.want) {
+			t.Errorf("%s: spreadDays = %v, want %v", tt.name, got, tt.want)
+			continue
+		}
+		var sum float64
+		for d, n := range got {
+			sum += n
+			if math.Abs(n-tt.want[d]) > 1e-9 {
+				t.Errorf("%s: spreadDays = %v, want %v", tt.name, got, tt.want)
+				break
+			}
+		}
+		if math.Abs(sum-tt.count) > 1e-9 {
+			t.Errorf("%s: spread %v messages, want all %v", tt.name, sum, tt.count)
+		}
+	}
+}
+
+func TestDetectAnomalies(t *testing.T) {
+	viper.Set("anomalyBaselineWeeks", 4)
+	viper.Set("anomalyZ", 3.0)
+	viper.Set("anomalyMinMessages", 100)
+	defer func() {
+		for _, key := range []string{"anomalyBaselineWeeks", "anomalyZ", "anomalyMinMessages"} {
+			viper.Set(key, nil)
+		}
+	}()
+
+	checked := time.Date(2018, 3, 7, 0, 0, 0, 0, time.UTC)
+	// the same count on the checked day's weekday over the baseline weeks, then n on the checked day
+	weekly := func(c dailyCount, baseline, n float64) []dailyCount {
+		var counts []dailyCount
+		for w := 1; w <= 4; w++ {
+			c.Day, c.Messages = checked.AddDate(0, 0, -7*w), baseline
+			counts = append(counts, c)
+		}
+		c.Day, c.Messages = checked, n
+		return append(counts, c)
+	}
+	failing := dailyCount{Domain: "wvu.edu", ASN: 64500}
+	passing := dailyCount{Domain: "wvu.edu", Sender: "Mailchimp", Passing: true}
+
+	tests := []struct {
+		name   string
+		counts []dailyCount
+		want   []string
+	}{
+		{"failing spike", weekly(failing, 10, 500), []string{"failing-spike AS64500"}},
+		{"failing spike under the minimum", weekly(failing, 0, 50), nil},
+		{"failing from an unknown ASN", weekly(dailyCount{Domain: "wvu.edu"}, 10, 500), []string{"failing-spike unknown ASN"}},
+		// without the floor, any change from a constant baseline would be infinitely many deviations
+		{"constant failing within the floor", weekly(failing, 1000, 1050), nil},
+		{"passing drop", weekly(passing, 200, 150), []string{"passing-drop Mailchimp"}},
+		{"passing dip within the floor", weekly(passing, 200, 190), nil},
+		{"passing drop under the minimum", weekly(passing, 50, 0), nil},
+		{"passing without a known sender", weekly(dailyCount{Domain: "wvu.edu", Passing: true}, 200, 0), nil},
+		{"no baseline", []dailyCount{{Day: checked, Domain: "wvu.edu", ASN: 64500, Messages: 500}}, []string{"failing-spike AS64500"}},
+	}
+	for _, tt := range tests {
+		var got []string
+		for _, a := range detectAnomalies(tt.counts, []time.Time{checked}) {
+			if !a.Day.Equal(checked) || a.Domain != "wvu.edu" {
+				t.Errorf("%s: flagged %+v, want %s of wvu.edu", tt.name, a, checked)
+			}
+			got = append(got, a.Kind+" "+a.Source)
+		}
+		if len(got) != len(tt.want) || (len(got) > 0 && got[0] != tt.want[0]) {
+			t.Errorf("%s: detectAnomalies = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestCheckedDays(t *testing.T) {
+	now := time.Date(2018, 3, 10, 15, 4, 5, 0, time.UTC)
+	tests := []struct {
+		last  int
+		first string
+		n     int
+	}{
+		{1, "2018-03-08", 1},
+		{7, "2018-03-02", 7},
+		{0, "", 0},
+		{-3, "", 0},
+	}
+	for _, tt := range tests {
+		days, err := checkedDays(now, tt.last)
+		if tt.n == 0 {
+			if err == nil {
+				t.Errorf("checkedDays(%d) = %v, want an error", tt.last, days)
+			}
+			continue
+		}
+		if err != nil || len(days) != tt.n || days[0].Format("2006-01-02") != tt.first || days[len(days)-1].Format("2006-01-02") != "2018-03-08" {
+			t.Errorf("checkedDays(%d) = %v, %v, want %d days from %s to the day before yesterday", tt.last, days, err, tt.n, tt.first)
+		}
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// rawReport is a report read from an attachment, along with the archived original it came from
+type rawReport struct {
+	Data     []byte
+	Hash     string
+	Filename string
+	// the report's file within the attachment, i.e. a member of a zip
+	Member string
+	// why the attachment's reports couldn't be extracted, to be logged like a report which can't be parsed
+	Err error
+}
+
+// extracts the reports of an original attachment
+func rawReports(hash, filename string, b []byte) ([]*rawReport, error) {
+	members, err := extractReports(filename, b)
+	if err != nil {
+		return nil, err
+	}
+	reports := make([]*rawReport, len(members))
+	for i, m := range members {
+		reports[i] = &rawReport{Data: m.Data, Hash: hash, Filename: filename, Member: m.Name}
+	}
+	return reports, nil
+}
+
+// returns where the original with the given hash is archived, i.e. archive/ab/abcdef...
+func archivePath(hash string) string {
+	return filepath.Join(viper.GetString("archiveDir"), hash[:2], hash)
+}
+
+// copies an attachment into the content addressed archive and records it in the "raw_reports" table,
+// returning its hash
+func archiveReport(b []byte, filename string) (string, error) {
+	sum := sha256.Sum256(b)
+	hash := hex.EncodeToString(sum[:])
+
+	// the same original is only archived once, however many times it's been sent
+	dest := archivePath(hash)
+	if _, err := os.Stat(dest); os.IsNotExist(err) {
+		if err = os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+			return "", err
+		}
+		// write beside the destination and rename over it, so a partial file is never archived
+		tmp, err := ioutil.TempFile(filepath.Dir(dest), hash)
+		if err != nil {
+			return "", err
+		}
+		defer os.Remove(tmp.Name())
+		if _, err = tmp.Write(b); err != nil {
+			tmp.Close()
+			return "", err
+		}
+		if err = tmp.Close(); err != nil {
+			return "", err
+		}
+		if err = os.Rename(tmp.Name(), dest); err != nil {
+			return "", err
+		}
+	} else if err != nil {
+		return "", err
+	}
+
+	_, err := db.Exec(rebind("INSERT INTO raw_reports (sha256, filename, size, archived_at) SELECT $1, $2, $3, $4 WHERE NOT EXISTS (SELECT 1 FROM raw_reports WHERE sha256 = $1)"),
+		hash, filename, len(b), time.Now().Unix())
+	return hash, err
+}
+
+// handles `dmarcdb reprocess <report id|archive hash>...`, re-parsing reports from their archived originals
+// and replacing what was stored from them
+func reprocess(ctx context.Context, args ...string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("Usage: dmarcdb reprocess <report id|archive hash>...")
+	}
+
+	for _, arg := range args {
+		hashes, err := archivedHashes(arg)
+		if err != nil {
+			return err
+		}
+		if len(hashes) == 0 {
+			return fmt.Errorf("No archived original found for \"%s\"", arg)
+		}
+		for _, hash := range hashes {
+			if err = reprocessArchived(ctx, hash); err != nil {
+				return fmt.Errorf("reprocessing %s: %s", hash, err)
+			}
+		}
+	}
+	return nil
+}
+
+// finds the archived originals matching a report id or archive hash
+func archivedHashes(arg string) ([]string, error) {
+	rows, err := db.Query(rebind("SELECT sha256 FROM raw_reports WHERE sha256 = $1 UNION SELECT raw_report FROM records WHERE report_id = $1 AND raw_report IS NOT NULL"), arg)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var hashes []string
+	for rows.Next() {
+		var hash string
+		if err = rows.Scan(&hash); err != nil {
+			return nil, err
+		}
+		hashes = append(hashes, hash)
+	}
+	return hashes, rows.Err()
+}
+
+// re-parses an archived original and stores its report in place of the previous one
+func reprocessArchived(ctx context.Context, hash string) error {
+	var filename string
+	if err := db.QueryRow(rebind("SELECT filename FROM raw_reports WHERE sha256 = $1"), hash).Scan(&filename); err != nil {
+		return err
+	}
+
+	b, err := ioutil.ReadFile(archivePath(hash))
+	if err != nil {
+		return err
+	}
+	if sum := sha256.Sum256(b); hex.EncodeToString(sum[:]) != hash {
+		return fmt.Errorf("archived original doesn't match its hash")
+	}
+
+	raws, err := rawReports(hash, filename, b)
+	if err != nil {
+		return err
+	}
+	for _, raw := range raws {
+		report, err := parseDMARC(bytes.NewReader(raw.Data))
+		if err != nil {
+			return fmt.Errorf("%s: %w", raw.Member, err)
+		}
+		report.RawReport, report.replace = hash, true
+		if err = report.store(ctx); err != nil {
+			return err
+		}
+		fmt.Printf("Reprocessed report %s from %s (%d records)\n", report.Metadata.ReportID, report.Metadata.OrgName, len(report.Records))
+	}
+	return nil
+}
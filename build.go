@@ -0,0 +1,429 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/go-ole/go-ole"
+	"github.com/go-ole/go-ole/oleutil"
+	"github.com/spf13/viper"
+	pb "gopkg.in/cheggaaa/pb.v1"
+)
+
+// a message's saved attachments, waiting to be parsed and stored by a report worker
+type mailJob struct {
+	seq      int
+	position int
+	id       string
+	subject  string
+	sender   string
+	received time.Time
+	// set when retrying, so stored reports replace what was stored from them before
+	replace bool
+	// set when building, so reports don't print their own progress over the build's
+	quiet       bool
+	attachments []*rawReport
+}
+
+// the outcome of processing a mailJob
+type mailResult struct {
+	job     *mailJob
+	reports int
+	records int
+	// reports skipped since they were stored before, i.e. when a message failed partway and is built again
+	stored int
+	// a report couldn't be parsed and was logged to the fail log, so the message isn't done
+	failed bool
+	err    error
+}
+
+// where a build of a mail folder got to, so an interrupted build can resume from it
+type checkpoint struct {
+	EntryID  string    `json:"entry_id"`
+	Position int       `json:"position"`
+	Received time.Time `json:"received"`
+	Updated  time.Time `json:"updated"`
+}
+
+// counters for the summary printed at the end of a build, kept by the bookkeeper
+type buildStats struct {
+	processed, failed, reports, records, stored int
+}
+
+// handles `dmarcdb build [--since 2018-01-31] [--restart] [folder/path]`, building the db from a mail folder
+func build(ctx context.Context, args ...string) error {
+	var (
+		flags   = flag.NewFlagSet("build", flag.ContinueOnError)
+		since   = flags.String("since", "", "only process mail received since, i.e. 30d or 2018-01-31")
+		restart = flags.Bool("restart", false, "ignore the folder's checkpoint and start from the beginning")
+	)
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	folderPath := viper.GetString("mailFolder")
+	// i.e. `dmarcdb build /path/to/folder` for spidering specific Outlook folder
+	if flags.NArg() >= 1 {
+		folderPath = flags.Arg(0)
+	}
+
+	sinceTime, err := parseSince(*since)
+	if err != nil {
+		return err
+	}
+
+	var (
+		ns      = oleutil.MustCallMethod(outlook, "GetNamespace", "MAPI").ToIDispatch()
+		folder  = getFolder(ns, strings.Split(folderPath, "/")...)
+		msgs    = oleutil.MustGetProperty(folder, "Items").ToIDispatch()
+		count   = int(oleutil.MustGetProperty(msgs, "Count").Value().(int32))
+		cp      checkpoint
+		started = time.Now()
+	)
+
+	// process oldest mail first, so the checkpoint only ever moves forward
+	oleutil.MustCallMethod(msgs, "Sort", "[ReceivedTime]", false)
+
+	if !*restart {
+		if cp, err = loadCheckpoint(folderPath); err != nil {
+			return err
+		}
+	}
+
+	from := sinceTime
+	if cp.Received.After(from) {
+		from = cp.Received
+		fmt.Printf("Resuming from checkpoint at message received %s\n", cp.Received.Format(time.RFC3339))
+	}
+	first := firstReceivedSince(msgs, count, from)
+	// step past the checkpoint's own message, which shares its received time with any messages before it
+	for i := first; i <= count && cp.EntryID != ""; i++ {
+		item := oleutil.MustCallMethod(msgs, "Item", i).ToIDispatch()
+		if !receivedTime(item).Equal(cp.Received) {
+			break
+		}
+		if oleutil.MustGetProperty(item, "EntryID").ToString() == cp.EntryID {
+			first = i + 1
+			break
+		}
+	}
+
+	var (
+		total      = count - first + 1
+		numWorkers = viper.GetInt("reportWorkers")
+		read       = 0
+		skipped    = 0
+		stats      buildStats
+		wg         sync.WaitGroup
+		jobs       = make(chan *mailJob)
+		results    = make(chan mailResult)
+		// closed by the bookkeeper on the first error, to stop reading new mail
+		abort = make(chan struct{})
+		done  = make(chan error, 1)
+	)
+	if total < 0 {
+		total = 0
+	}
+	if numWorkers < 1 {
+		numWorkers = 1
+	}
+	fmt.Printf("%d of %d messages in %s to process\n", total, count, folderPath)
+
+	// one bar for the whole build, only updated by the bookkeeper, rather than one per report from every worker
+	bar := pb.New(total).Prefix("Messages ")
+	bar.ShowTimeLeft = true
+	bar.ShowSpeed = true
+	bar.Start()
+
+	// report workers parse and store each message's reports, each report in its own transaction
+	for w := 0; w < numWorkers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range jobs {
+				results <- job.process(ctx)
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+	go func() {
+		done <- bookkeep(folderPath, results, abort, &stats, bar)
+	}()
+
+	// Outlook's COM objects are only touched from this goroutine, which saves each message's
+	// attachments and hands them off to the report workers
+loop:
+	for i := first; i <= count; i++ {
+		var job *mailJob
+		job, err = readMail(oleutil.MustCallMethod(msgs, "Item", i))
+		if err == errDuplicateRecord {
+			skipped++
+			err = nil
+			continue
+		} else if err != nil {
+			err = fmt.Errorf("reading message %d of %s: %s", i, folderPath, err)
+			close(jobs)
+			<-done
+			bar.Finish()
+			return err
+		}
+
+		job.seq, job.position, job.quiet = read, i, true
+		read++
+		select {
+		case jobs <- job:
+		case <-abort:
+			break loop
+		case <-ctx.Done():
+			fmt.Println("Interrupted, waiting for reports in progress to roll back")
+			break loop
+		}
+
+		if viper.GetString("environment") == "dev" {
+			break
+		}
+	}
+	close(jobs)
+	err = <-done
+	bar.Finish()
+
+	elapsed := time.Since(started)
+	fmt.Printf("Processed %d messages (%d reports, %d records, %d reports already stored), skipped %d already processed, %d failed, %d not reached, took %s\n",
+		stats.processed, stats.reports, stats.records, stats.stored, skipped, stats.failed, total-stats.processed-stats.failed-skipped, elapsed)
+	if secs := elapsed.Seconds(); secs > 0 {
+		fmt.Printf("Throughput: %.2f messages/s, %.2f reports/s, %.2f records/s with %d report workers\n",
+			float64(stats.processed+stats.failed)/secs, float64(stats.reports)/secs, float64(stats.records)/secs, numWorkers)
+	}
+
+	if ctx.Err() != nil {
+		return fmt.Errorf("Build of %s interrupted, the next build resumes from its checkpoint", folderPath)
+	}
+	if err == nil && stats.reports > 0 && viper.GetBool("rollupAfterBuild") {
+		err = rollup(ctx, false)
+	}
+	return err
+}
+
+// finds the position of the first message received at or after t, in Items sorted by received time
+func firstReceivedSince(msgs *ole.IDispatch, count int, t time.Time) int {
+	if t.IsZero() {
+		return 1
+	}
+	return 1 + sort.Search(count, func(i int) bool {
+		item := oleutil.MustCallMethod(msgs, "Item", i+1).ToIDispatch()
+		return !receivedTime(item).Before(t)
+	})
+}
+
+// who sent a message, which for a broken or hostile report is all we know about its reporter
+func senderAddress(item *ole.IDispatch) string {
+	if v, err := oleutil.GetProperty(item, "SenderEmailAddress"); err == nil {
+		return v.ToString()
+	}
+	return "unknown sender"
+}
+
+func receivedTime(item *ole.IDispatch) time.Time {
+	if t, ok := oleutil.MustGetProperty(item, "ReceivedTime").Value().(time.Time); ok {
+		return t
+	}
+	return time.Time{}
+}
+
+// flags messages as processed in the order they were read, whatever order their reports finish storing in,
+// and moves the folder's checkpoint forward over every message before the first one which failed
+func bookkeep(folderPath string, results <-chan mailResult, abort chan struct{}, stats *buildStats, bar *pb.ProgressBar) error {
+	var (
+		pending = map[int]mailResult{}
+		next    = 0
+		err     error
+		// set once a message's reports have failed, holding the checkpoint before it so it's read again next build
+		held bool
+	)
+
+	for result := range results {
+		pending[result.job.seq] = result
+		for {
+			r, ok := pending[next]
+			if !ok {
+				break
+			}
+			delete(pending, next)
+			next++
+
+			bar.Increment()
+			if r.err != nil {
+				stats.failed++
+				if err == nil {
+					err = r.err
+					close(abort)
+				}
+				continue
+			}
+
+			stats.reports += r.reports
+			stats.records += r.records
+			stats.stored += r.stored
+			if r.failed {
+				stats.failed++
+				held = true
+			} else {
+				stats.processed++
+			}
+
+			// messages after one which failed or errored are still flagged, so they aren't stored twice,
+			// but the checkpoint stays before the failure so it's retried on the next build
+			markErr := bdb.Update(func(tx *bolt.Tx) error {
+				if !r.failed {
+					if err := tx.Bucket([]byte("processed-mail")).Put([]byte(r.job.id), []byte{1}); err != nil {
+						return err
+					}
+				}
+				if err != nil || held {
+					return nil
+				}
+				return saveCheckpoint(tx, folderPath, checkpoint{
+					EntryID:  r.job.id,
+					Position: r.job.position,
+					Received: r.job.received,
+					Updated:  time.Now(),
+				})
+			})
+			if markErr != nil && err == nil {
+				err = markErr
+				close(abort)
+			}
+			bar.Postfix(fmt.Sprintf(" %d reports, %d records, %d failed", stats.reports, stats.records, stats.failed))
+		}
+	}
+	return err
+}
+
+func loadCheckpoint(folderPath string) (checkpoint, error) {
+	var cp checkpoint
+	err := bdb.View(func(tx *bolt.Tx) error {
+		if v := tx.Bucket([]byte("checkpoints")).Get([]byte(folderPath)); v != nil {
+			return json.Unmarshal(v, &cp)
+		}
+		return nil
+	})
+	return cp, err
+}
+
+func saveCheckpoint(tx *bolt.Tx, folderPath string, cp checkpoint) error {
+	v, err := json.Marshal(cp)
+	if err != nil {
+		return err
+	}
+	return tx.Bucket([]byte("checkpoints")).Put([]byte(folderPath), v)
+}
+
+// checks if a message is new and saves its attachments for processing
+func readMail(val *ole.VARIANT) (*mailJob, error) {
+	var (
+		message = val.ToIDispatch()
+		id      = oleutil.MustGetProperty(message, "EntryID").ToString()
+		isDupe  = false
+	)
+
+	// check if mail has already been processed
+	bdb.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("processed-mail")).Get([]byte(id))
+		if b != nil && bytes.Equal(b, []byte{1}) {
+			isDupe = true
+		}
+		return nil
+	})
+
+	// if it's a dupe and we're configured to skip dupes, then skip it
+	if !viper.GetBool("duplicates") && isDupe {
+		return nil, errDuplicateRecord
+	}
+
+	return newMailJob(message)
+}
+
+// saves a message's attachments for processing
+func newMailJob(message *ole.IDispatch) (*mailJob, error) {
+	var (
+		attachments = oleutil.MustGetProperty(message, "Attachments").ToIDispatch()
+		numAtt      = oleutil.MustGetProperty(attachments, "Count").Value().(int32)
+		job         = &mailJob{
+			id:       oleutil.MustGetProperty(message, "EntryID").ToString(),
+			subject:  oleutil.MustGetProperty(message, "Subject").ToString(),
+			sender:   senderAddress(message),
+			received: receivedTime(message),
+		}
+	)
+	// for each attachment on the mail
+	for i := 1; int32(i) <= numAtt; i++ {
+		attachment := oleutil.MustGetProperty(message, "Attachments", i).ToIDispatch()
+		reports, err := openAttachment(attachment)
+		if err != nil {
+			return nil, err
+		}
+		job.attachments = append(job.attachments, reports...)
+	}
+	return job, nil
+}
+
+// parses and stores each report attached to a message
+func (job *mailJob) process(ctx context.Context) mailResult {
+	result := mailResult{job: job}
+
+	for _, r := range job.attachments {
+		// don't start on another report once interrupted
+		if result.err = ctx.Err(); result.err != nil {
+			return result
+		}
+
+		// parse the XML file as a DMARC aggregate report
+		var (
+			report *DMARCFeedback
+			err    = r.Err
+		)
+		if err == nil {
+			if report, err = parseDMARC(bytes.NewReader(r.Data)); err != nil {
+				err = fmt.Errorf("%s: %w", r.Member, err)
+			}
+		}
+		if err != nil {
+			// if we've configured to stop processing on any broken DMARC report, return an error
+			if viper.GetBool("stopOnError") {
+				result.err = err
+				return result
+			}
+			// else, log the broken DMARC report so we can later harass the offending aggregate report sender for why their reports are broken
+			err = recordFailure(job, r, err)
+			// if there's an error logging the report so we can later harass the offending aggregate report sender,
+			// return an error and harass ourselves
+			result.err = err
+			result.failed = true
+			return result
+		}
+
+		// store each report in the database, linked to the original it was archived as
+		report.RawReport, report.replace, report.quiet = r.Hash, job.replace, job.quiet
+		if err = report.store(ctx); err == errReportStored {
+			result.stored++
+			continue
+		} else if err != nil {
+			result.err = err
+			return result
+		}
+		result.reports++
+		result.records += len(report.Records)
+	}
+	return result
+}
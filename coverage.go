@@ -0,0 +1,271 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// a reporter's aggregate reports for one of our domains, oldest first
+type reporterCoverage struct {
+	Reporter  string        `json:"reporter"`
+	Domain    string        `json:"domain"`
+	Reports   int           `json:"reports"`
+	Cadence   time.Duration `json:"-"`
+	FirstSeen time.Time     `json:"first_seen"`
+	LastEnd   time.Time     `json:"last_report_end"`
+	Overdue   time.Duration `json:"-"`
+	// the durations as i.e. "24h0m0s", since JSON would have them in nanoseconds
+	CadenceText string       `json:"cadence"`
+	OverdueText string       `json:"overdue,omitempty"`
+	New         bool         `json:"new,omitempty"`
+	Issues      []rangeIssue `json:"issues,omitempty"`
+	ranges      []reportRange
+}
+
+type reportRange struct {
+	begin, end time.Time
+}
+
+// a gap between or overlap of two consecutive reports' date ranges
+type rangeIssue struct {
+	Kind string    `json:"kind"`
+	From time.Time `json:"from"`
+	To   time.Time `json:"to"`
+}
+
+// handles `dmarcdb coverage [--since 90d] [--domain wvu.edu] [--new 7d] [--json] [--alert]`, listing reporters
+// whose reports are overdue, whose date ranges have gaps or overlaps, and who reported for the first time
+func coverage(args ...string) error {
+	var (
+		flags    = flag.NewFlagSet("coverage", flag.ContinueOnError)
+		since    = flags.String("since", "90d", "look at reports since, i.e. 90d or 2018-01-31, to learn each reporter's cadence")
+		domain   = flags.String("domain", "", "only reports for this domain")
+		newSince = flags.String("new", "7d", "reporters first seen since this are new")
+		asJSON   = flags.Bool("json", false, "print each reporter's coverage as JSON")
+		alert    = flags.Bool("alert", false, "exit with an error if any reporter is overdue, i.e. from a scheduled task")
+	)
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	sinceTime, err := parseSince(*since)
+	if err != nil {
+		return err
+	}
+	newTime, err := parseSince(*newSince)
+	if err != nil {
+		return err
+	}
+
+	covs, err := loadCoverage(sinceTime, *domain)
+	if err != nil {
+		return err
+	}
+	history, err := reporterHistory(*domain)
+	if err != nil {
+		return err
+	}
+	// reporters which stopped before --since are still due, having last reported when their history ends
+	seen := map[[2]string]bool{}
+	for _, c := range covs {
+		seen[[2]string{c.Reporter, c.Domain}] = true
+	}
+	for key := range history {
+		if !seen[key] {
+			covs = append(covs, &reporterCoverage{Reporter: key[0], Domain: key[1]})
+		}
+	}
+	sort.Slice(covs, func(i, j int) bool {
+		if covs[i].Reporter != covs[j].Reporter {
+			return covs[i].Reporter < covs[j].Reporter
+		}
+		return covs[i].Domain < covs[j].Domain
+	})
+
+	var overdue int
+	for _, c := range covs {
+		span := history[[2]string{c.Reporter, c.Domain}]
+		c.FirstSeen, c.LastEnd = span.first, span.lastEnd
+		c.analyze(time.Now())
+		c.New = !c.FirstSeen.Before(newTime)
+		if c.Overdue > 0 {
+			overdue++
+		}
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(covs)
+	} else {
+		err = printCoverage(covs)
+	}
+	if err == nil && *alert && overdue > 0 {
+		err = fmt.Errorf("%d reporters are overdue", overdue)
+	}
+	return err
+}
+
+// loads the date ranges of each reporter's reports per domain since a time, a report being its distinct range
+// since records stored before report_id don't have one
+func loadCoverage(since time.Time, domain string) ([]*reporterCoverage, error) {
+	var (
+		cols   = []string{"org_name", "domain"}
+		conds  = "date_range_begin >= $1"
+		params = []interface{}{since.Unix()}
+	)
+	if since.IsZero() {
+		params[0] = int64(0)
+	}
+	if domain != "" {
+		conds += " AND " + textCol("domain") + " = $2"
+		params = append(params, domain)
+	}
+	query := fmt.Sprintf("SELECT %s, date_range_begin, date_range_end FROM records WHERE %s GROUP BY %s, date_range_begin, date_range_end ORDER BY %s, date_range_begin",
+		selectGrouped(cols...), conds, groupBy(cols...), groupBy(cols...))
+	rows, err := db.Query(rebind(query), params...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var (
+		covs []*reporterCoverage
+		cur  *reporterCoverage
+	)
+	for rows.Next() {
+		var (
+			reporter, dom sql.NullString
+			begin, end    sql.NullInt64
+		)
+		if err = rows.Scan(&reporter, &dom, &begin, &end); err != nil {
+			return nil, err
+		}
+		if cur == nil || cur.Reporter != reporter.String || cur.Domain != dom.String {
+			cur = &reporterCoverage{Reporter: reporter.String, Domain: dom.String}
+			covs = append(covs, cur)
+		}
+		cur.ranges = append(cur.ranges, reportRange{time.Unix(begin.Int64, 0).UTC(), time.Unix(end.Int64, 0).UTC()})
+	}
+	return covs, rows.Err()
+}
+
+// when each reporter's reports on a domain began and ended
+type reporterSpan struct {
+	first, lastEnd time.Time
+}
+
+// when each reporter first reported on each domain and when its last report ended, across all stored records
+func reporterHistory(domain string) (map[[2]string]reporterSpan, error) {
+	var (
+		cols   = []string{"org_name", "domain"}
+		conds  = "1 = 1"
+		params []interface{}
+	)
+	if domain != "" {
+		conds = textCol("domain") + " = $1"
+		params = append(params, domain)
+	}
+	query := fmt.Sprintf("SELECT %s, MIN(date_range_begin), MAX(date_range_end) FROM records WHERE %s GROUP BY %s", selectGrouped(cols...), conds, groupBy(cols...))
+	rows, err := db.Query(rebind(query), params...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	spans := map[[2]string]reporterSpan{}
+	for rows.Next() {
+		var (
+			reporter, dom sql.NullString
+			begin, end    sql.NullInt64
+		)
+		if err = rows.Scan(&reporter, &dom, &begin, &end); err != nil {
+			return nil, err
+		}
+		spans[[2]string{reporter.String, dom.String}] = reporterSpan{time.Unix(begin.Int64, 0).UTC(), time.Unix(end.Int64, 0).UTC()}
+	}
+	return spans, rows.Err()
+}
+
+// learns a reporter's cadence from the median time between its reports, finds gaps and overlaps between
+// consecutive ranges, and whether its next report is later than coverageOverdueFactor cadences after LastEnd
+// (its last report's end, from all its history when set beforehand)
+func (c *reporterCoverage) analyze(now time.Time) {
+	var (
+		tolerance = viper.GetDuration("coverageGapTolerance")
+		intervals []time.Duration
+	)
+	c.Reports = len(c.ranges)
+	for i, r := range c.ranges {
+		if r.end.After(c.LastEnd) {
+			c.LastEnd = r.end
+		}
+		if i == 0 {
+			continue
+		}
+		prev := c.ranges[i-1]
+		intervals = append(intervals, r.begin.Sub(prev.begin))
+		switch {
+		case r.begin.Sub(prev.end) > tolerance:
+			c.Issues = append(c.Issues, rangeIssue{"gap", prev.end, r.begin})
+		case prev.end.Sub(r.begin) > tolerance:
+			c.Issues = append(c.Issues, rangeIssue{"overlap", r.begin, prev.end})
+		}
+	}
+
+	// most reporters send daily, so a reporter seen once is assumed to
+	c.Cadence = 24 * time.Hour
+	if len(intervals) > 0 {
+		sort.Slice(intervals, func(i, j int) bool { return intervals[i] < intervals[j] })
+		if median := intervals[len(intervals)/2]; median > 0 {
+			c.Cadence = median
+		}
+	}
+
+	due := c.LastEnd.Add(time.Duration(viper.GetFloat64("coverageOverdueFactor") * float64(c.Cadence)))
+	if now.After(due) {
+		c.Overdue = now.Sub(due).Truncate(time.Hour)
+		c.OverdueText = c.Overdue.String()
+	}
+	c.CadenceText = c.Cadence.String()
+}
+
+func printCoverage(covs []*reporterCoverage) error {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "OVERDUE REPORTER\tDOMAIN\tREPORTS\tCADENCE\tLAST REPORT END\tOVERDUE BY")
+	for _, c := range covs {
+		if c.Overdue > 0 {
+			fmt.Fprintf(w, "%s\t%s\t%d\t%s\t%s\t%s\n", c.Reporter, c.Domain, c.Reports, c.Cadence, c.LastEnd.Format("2006-01-02 15:04"), c.Overdue)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	fmt.Println()
+	fmt.Fprintln(w, "REPORTER\tDOMAIN\tISSUE\tFROM\tTO\tLENGTH")
+	for _, c := range covs {
+		for _, issue := range c.Issues {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", c.Reporter, c.Domain, issue.Kind, issue.From.Format("2006-01-02 15:04"), issue.To.Format("2006-01-02 15:04"), issue.To.Sub(issue.From))
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	fmt.Println()
+	fmt.Fprintln(w, "NEW REPORTER\tDOMAIN\tFIRST SEEN\tREPORTS")
+	for _, c := range covs {
+		if c.New {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%d\n", c.Reporter, c.Domain, c.FirstSeen.Format("2006-01-02"), c.Reports)
+		}
+	}
+	return w.Flush()
+}
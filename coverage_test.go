@@ -0,0 +1,65 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+func TestAnalyzeCoverage(t *testing.T) {
+	viper.Set("coverageGapTolerance", "1h")
+	viper.Set("coverageOverdueFactor", 2.0)
+	defer viper.Set("coverageGapTolerance", nil)
+	defer viper.Set("coverageOverdueFactor", nil)
+
+	var (
+		now = time.Date(2018, 3, 10, 12, 0, 0, 0, time.UTC)
+		// a report covering the day n days before now's
+		daily = func(n int) reportRange {
+			begin := now.Truncate(day).AddDate(0, 0, -n)
+			return reportRange{begin, begin.Add(day)}
+		}
+	)
+	tests := []struct {
+		name    string
+		ranges  []reportRange
+		lastEnd time.Time
+		cadence time.Duration
+		overdue time.Duration
+		issues  []string
+	}{
+		{"daily", []reportRange{daily(3), daily(2), daily(1)}, time.Time{}, day, 0, nil},
+		// the median of an even number of intervals is the longer middle one
+		{"gap", []reportRange{daily(4), daily(3), daily(1)}, time.Time{}, 2 * day, 0, []string{"gap"}},
+		{"gap within tolerance", []reportRange{daily(2), {daily(1).begin.Add(30 * time.Minute), daily(1).end}}, time.Time{}, day + 30*time.Minute, 0, nil},
+		{"overlap", []reportRange{daily(3), {daily(2).begin.Add(-12 * time.Hour), daily(2).end}}, time.Time{}, 12 * time.Hour, 12 * time.Hour, []string{"overlap"}},
+		{"hourly", []reportRange{
+			{now.Add(-3 * time.Hour), now.Add(-2 * time.Hour)},
+			{now.Add(-2 * time.Hour), now.Add(-time.Hour)},
+		}, time.Time{}, time.Hour, 0, nil},
+		// a single report is assumed daily, and is overdue two days after it ended
+		{"stopped", []reportRange{daily(4)}, time.Time{}, day, 36 * time.Hour, nil},
+		{"weekly and on time", []reportRange{
+			{now.AddDate(0, 0, -15), now.AddDate(0, 0, -8)},
+			{now.AddDate(0, 0, -8), now.AddDate(0, 0, -1)},
+		}, time.Time{}, 7 * day, 0, nil},
+		// a reporter which stopped before --since has no ranges, only its history's last end
+		{"stopped before since", nil, now.AddDate(0, 0, -30), day, 28 * day, nil},
+		{"history ends after since", []reportRange{daily(5)}, now.Add(-time.Hour), day, 0, nil},
+	}
+	for _, tt := range tests {
+		c := &reporterCoverage{Reporter: "google.com", Domain: "wvu.edu", LastEnd: tt.lastEnd, ranges: tt.ranges}
+		c.analyze(now)
+		var issues []string
+		for _, issue := range c.Issues {
+			issues = append(issues, issue.Kind)
+		}
+		if c.Cadence != tt.cadence || c.Overdue != tt.overdue || len(issues) != len(tt.issues) || (len(issues) > 0 && issues[0] != tt.issues[0]) {
+			t.Errorf("%s: cadence %s, overdue %s, issues %v, want %s, %s, %v", tt.name, c.Cadence, c.Overdue, issues, tt.cadence, tt.overdue, tt.issues)
+		}
+		if c.Reports != len(tt.ranges) {
+			t.Errorf("%s: %d reports, want %d", tt.name, c.Reports, len(tt.ranges))
+		}
+	}
+}
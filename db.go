@@ -1,9 +1,10 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
-	"net"
+	"regexp"
 	"strings"
 	"sync"
 
@@ -15,30 +16,101 @@ import (
 )
 
 var (
-	cols = []string{"org_name", "email", "contact_info", "date_range_begin", "date_range_end", "domain", "adkim", "aspf", "p", "pct", "location", "source_ip", "count", "disposition", "dkim", "spf", "reason_type", "comment", "envelope_to", "header_from", "dkim_domain", "dkim_result", "dkim_hresult", "spf_domain", "spf_result", "hostname"}
+	placeholders = regexp.MustCompile(`\$(\d+)`)
+
+	// read locked by each report while it's being stored, so the rollup can wait for their records to be committed
+	storing sync.RWMutex
+
+	cols = []string{"org_name", "email", "contact_info", "date_range_begin", "date_range_end", "domain", "adkim", "aspf", "p", "pct", "location", "source_ip", "count", "disposition", "dkim", "spf", "reason_type", "comment", "envelope_to", "header_from", "dkim_domain", "dkim_result", "dkim_hresult", "spf_domain", "spf_result", "hostname", "dnsbl", "asn", "sender", "spf_eval", "spf_mechanism", "spf_lookups", "policy_drift", "geo_build", "record_key", "enrich_pending", "report_id", "raw_report", "dkim_alignment", "spf_alignment", "org_domain"}
 )
 
+// returns the database/sql driver name for the configured database
+func dialect() string {
+	if strings.Split(viper.GetString("database"), "://")[0] == "postgres" {
+		return "postgres"
+	}
+	return "sqlserver"
+}
+
+// rewrites a query's $n placeholders to the configured database's syntax (@pn for sqlserver)
+func rebind(query string) string {
+	if dialect() == "postgres" {
+		return query
+	}
+	return placeholders.ReplaceAllString(query, "@p$1")
+}
+
+// limits a query's results to the first n rows in the configured database's syntax
+func limit(query string, n int) string {
+	if dialect() == "postgres" {
+		return fmt.Sprintf("%s LIMIT %d", query, n)
+	}
+	return strings.Replace(query, "SELECT", fmt.Sprintf("SELECT TOP %d", n), 1)
+}
+
+// returns a column as an expression which can be compared and grouped by, since MSSQL can do neither with its text columns
+func textCol(col string) string {
+	if dialect() == "postgres" {
+		return col
+	}
+	return fmt.Sprintf("CAST(%s AS varchar(max))", col)
+}
+
 // MaxWorkers defines the maximum number of running workers (via goroutines)
 const MaxWorkers = 1000
 
-func (report *DMARCFeedback) store() error {
+// an enriched record, ready to be copied into the "records" table
+type recordRow struct {
+	index    int
+	key      string
+	values   []interface{}
+	results  []enrichment
+	sighting sighting
+}
+
+// stores a report as a pipeline: parallel workers enrich each record into a row, and a single writer
+// streams the rows into the bulk copy, rolling back the whole report if any row can't be written
+// or ctx is canceled before it's committed. A report which is already stored, i.e. from a message which
+// failed partway and is being built again, returns errReportStored unless it's replacing what was stored
+// or duplicates are configured to be inserted again
+func (report *DMARCFeedback) store(ctx context.Context) (err error) {
+	if !report.replace && !viper.GetBool("duplicates") {
+		var stored bool
+		if stored, err = report.stored(ctx); err != nil {
+			return err
+		} else if stored {
+			return errReportStored
+		}
+	}
+
+	// flag the report if the policy it saw isn't what we published at the time
+	if report.PolicyDrift, err = report.policyDrift(); err != nil {
+		return err
+	}
+
+	storing.RLock()
+	defer storing.RUnlock()
+
 	// begin a transaction (i.e. all data inserted to db at once, all goes or nothing)
-	txn, err := db.Begin()
+	txn, err := db.BeginTx(ctx, nil)
 	if err != nil {
 		return err
 	}
+	defer func() {
+		if err != nil {
+			txn.Rollback()
+		}
+	}()
 
-	// prepare the insert into the "records" table
-	var query string
-	switch strings.Split(viper.GetString("database"), "://")[0] {
-	case "postgres":
-		query = pq.CopyIn("records", cols...)
-	default:
-		opts := mssql.MssqlBulkOptions{}
-		query = mssql.CopyIn("records", opts, cols...)
+	// a reprocessed report replaces what was stored from it before, in the same transaction
+	if report.replace {
+		if err = report.deleteStored(txn); err != nil {
+			return err
+		}
 	}
 
-	stmt, err := txn.Prepare(query)
+	// prepare the insert into the "records" table
+	stmt, err := copyIn(txn, "records", cols...)
 	if err != nil {
 		return err
 	}
@@ -47,6 +119,13 @@ func (report *DMARCFeedback) store() error {
 		// scale numWorkers linearly with respect to number of records to lookup
 		numWorkers = (len(report.Records) + 30) / 15
 		wg         sync.WaitGroup
+		jobs       = make(chan int)
+		rows       = make(chan recordRow)
+		// closed when the writer gives up, to stop the feeder and workers early
+		abort    = make(chan struct{})
+		enriched = map[string][]enrichment{}
+		// the first record of each source sending as each domain, to note in "sender_first_seen"
+		sightings = map[[2]string]sighting{}
 	)
 
 	// cap max workers at MaxWorkers
@@ -54,25 +133,74 @@ func (report *DMARCFeedback) store() error {
 		numWorkers = MaxWorkers
 	}
 
-	workers := make(chan bool, numWorkers)
 	bar := pb.New(len(report.Records)).Prefix(fmt.Sprintf("Records (%d) ", numWorkers))
 	bar.ShowTimeLeft = false
 	bar.ShowSpeed = true
+	bar.NotPrint = report.quiet
 	bar.Start()
 
-	for _, record := range report.Records {
+	go func() {
+		defer close(jobs)
+		for i := range report.Records {
+			select {
+			case jobs <- i:
+			case <-abort:
+				return
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	for w := 0; w < numWorkers; w++ {
 		wg.Add(1)
-		workers <- true
-		go func(record DMARCRecord) {
+		go func() {
 			defer wg.Done()
-			defer func() { <-workers }()
-			insert(stmt, report, record)
-			bar.Increment()
-		}(record)
+			for i := range jobs {
+				var (
+					record         = report.Records[i]
+					key            = report.recordKey(i)
+					attrs, results = enrich(ctx, report, record)
+				)
+				select {
+				case rows <- recordRow{i, key, report.row(record, key, attrs), results, report.sighting(i, key, record, attrs)}:
+				case <-abort:
+					return
+				}
+			}
+		}()
+	}
+
+	go func() {
+		wg.Wait()
+		close(rows)
+	}()
+
+	// the prepared bulk copy isn't safe for concurrent use, so only this goroutine writes to it
+	for row := range rows {
+		if _, err = stmt.Exec(row.values...); err != nil {
+			close(abort)
+			for range rows {
+			}
+			stmt.Close()
+			bar.Finish()
+			return fmt.Errorf("storing record %d (source %s) of report %s from %s: %s", row.index+1, report.Records[row.index].SourceIP, report.Metadata.ReportID, report.Metadata.OrgName, err)
+		}
+		enriched[row.key] = row.results
+		id := [2]string{row.sighting.domain, row.sighting.network}
+		if s, ok := sightings[id]; !ok || row.index < s.index {
+			sightings[id] = row.sighting
+		}
+		bar.Increment()
 	}
-	wg.Wait()
 	bar.Finish()
 
+	// an interrupted report is rolled back rather than committed with records missing
+	if err = ctx.Err(); err != nil {
+		stmt.Close()
+		return err
+	}
+
 	// exec once more to flush buffered data
 	_, err = stmt.Exec()
 	if err != nil {
@@ -85,38 +213,91 @@ func (report *DMARCFeedback) store() error {
 		return err
 	}
 
+	// store each enricher's output in the side table, once the records are all copied in
+	if err = storeAttributes(txn, enriched); err != nil {
+		return err
+	}
+
+	// note sources sending as our domains for the first time
+	if err = storeSightings(txn, report.Metadata.DateRangeBegin, sightings); err != nil {
+		return err
+	}
+
 	// commit the transaction
 	return txn.Commit()
 }
 
-// inserts a record into the datbase using the prepared stmt
-func insert(stmt *sql.Stmt, report *DMARCFeedback, record DMARCRecord) error {
-	var (
-		host       = lookupHost(record.SourceIP)
-		ip         = net.ParseIP(record.SourceIP)
-		country, _ = geoCityDB.Country(ip)
-		asn, _     = geoASNdb.ASN(ip)
-		city, _    = geoCityDB.City(ip)
-		loc        = "%s/%s"
-		contact    string
-		err        error
-	)
+// reports whether any records have been stored from the report, by its reporter and report_id
+func (report *DMARCFeedback) stored(ctx context.Context) (bool, error) {
+	var found int
+	query := limit(fmt.Sprintf("SELECT 1 FROM records WHERE %s = $1 AND report_id = $2", textCol("org_name")), 1)
+	err := db.QueryRowContext(ctx, rebind(query), report.Metadata.OrgName, report.Metadata.ReportID).Scan(&found)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// deletes the records and attributes previously stored from the report
+func (report *DMARCFeedback) deleteStored(txn *sql.Tx) error {
+	_, err := txn.Exec(rebind(fmt.Sprintf("DELETE FROM record_attributes WHERE record_key IN (SELECT record_key FROM records WHERE %s = $1 AND report_id = $2)", textCol("org_name"))), report.Metadata.OrgName, report.Metadata.ReportID)
+	if err != nil {
+		return err
+	}
+	_, err = txn.Exec(rebind(fmt.Sprintf("DELETE FROM records WHERE %s = $1 AND report_id = $2", textCol("org_name"))), report.Metadata.OrgName, report.Metadata.ReportID)
+	return err
+}
+
+// prepares a bulk insert into table within txn, using the configured database's bulk copy
+func copyIn(txn *sql.Tx, table string, columns ...string) (*sql.Stmt, error) {
+	var query string
+	switch dialect() {
+	case "postgres":
+		query = pq.CopyIn(table, columns...)
+	default:
+		opts := mssql.MssqlBulkOptions{}
+		query = mssql.CopyIn(table, opts, columns...)
+	}
+	return txn.Prepare(query)
+}
 
-	if len(city.Subdivisions) > 0 {
-		loc = fmt.Sprintf(loc, city.Subdivisions[0].IsoCode, country.Country.IsoCode)
-	} else {
-		loc = country.Country.IsoCode
+// stores the output of every enricher for each record key in the "record_attributes" table
+func storeAttributes(txn *sql.Tx, enriched map[string][]enrichment) error {
+	stmt, err := copyIn(txn, "record_attributes", "record_key", "enricher", "name", "value")
+	if err != nil {
+		return err
 	}
 
-	if asn != nil {
-		contact = asn.AutonomousSystemOrganization
+	for key, results := range enriched {
+		for _, result := range results {
+			// keep failures alongside the output, so a broken enricher can be told apart from an empty one
+			if result.Err != nil {
+				if _, err = stmt.Exec(key, result.Enricher, "error", result.Err.Error()); err != nil {
+					return err
+				}
+			}
+			for name, value := range result.Attrs {
+				if _, err = stmt.Exec(key, result.Enricher, name, value); err != nil {
+					return err
+				}
+			}
+		}
 	}
+
+	if _, err = stmt.Exec(); err != nil {
+		return err
+	}
+	return stmt.Close()
+}
+
+// returns the values of a record and its enriched attributes, in the order of cols
+func (report *DMARCFeedback) row(record DMARCRecord, key string, attrs Attributes) []interface{} {
+	contact := attrs["asn_org"]
 	if report.Metadata.ExtraContactInfo != "NULL" {
 		contact += report.Metadata.ExtraContactInfo
 	}
 
-	_, err = stmt.Exec(report.Metadata.OrgName, report.Metadata.Email, contact, report.Metadata.DateRangeBegin, report.Metadata.DateRangeEnd, report.Policy.Domain, report.Policy.ADKIM, report.Policy.ASPF, report.Policy.P, report.Policy.PCT, loc, record.SourceIP, record.Count, record.Disposition, record.DKIM, record.SPF, record.ReasonType, record.ReasonComment, record.EnvelopeTo, record.HeaderFrom, record.DKIMDomain, record.DKIMResult, record.DKIMHResult, record.SPFDomain, record.SPFResult, host)
-	return err
+	return []interface{}{report.Metadata.OrgName, report.Metadata.Email, contact, report.Metadata.DateRangeBegin, report.Metadata.DateRangeEnd, report.Policy.Domain, report.Policy.ADKIM, report.Policy.ASPF, report.Policy.P, report.Policy.PCT, attrs["location"], record.SourceIP, record.Count, record.Disposition, record.DKIM, record.SPF, record.ReasonType, record.ReasonComment, record.EnvelopeTo, record.HeaderFrom, record.DKIMDomain, record.DKIMResult, record.DKIMHResult, record.SPFDomain, record.SPFResult, attrs["hostname"], attrs["dnsbl"], attrs.intValue("asn"), attrs["sender"], attrs["spf_eval"], attrs["spf_mechanism"], attrs.intValue("spf_lookups"), report.PolicyDrift, attrs.intValue("geo_build"), key, enrichPending(), report.Metadata.ReportID, report.RawReport, attrs["dkim_alignment"], attrs["spf_alignment"], attrs["org_domain"]}
 }
 
 func retrieve(query string) (map[string]interface{}, error) {
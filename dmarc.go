@@ -1,12 +1,16 @@
 package main
 
 import (
+	"bytes"
+	"encoding/xml"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"strconv"
 	"strings"
 
 	"github.com/antchfx/xquery/xml"
+	"github.com/spf13/viper"
 )
 
 type DMARCMetadata struct {
@@ -41,16 +45,44 @@ type DMARCRecord struct {
 	DKIMHResult   string `xml:"auth_results>dkim>human_result"`
 	SPFDomain     string `xml:"auth_results>spf>domain"`
 	SPFResult     string `xml:"auth_results>spf>result"`
+	// every DKIM signature the receiver checked, of which the DKIM* fields above are the one that aligns best
+	DKIMResults []DKIMAuthResult `xml:"auth_results>dkim"`
+}
+
+type DKIMAuthResult struct {
+	Domain      string `xml:"domain"`
+	Selector    string `xml:"selector"`
+	Result      string `xml:"result"`
+	HumanResult string `xml:"human_result"`
 }
 
 type DMARCFeedback struct {
 	Metadata DMARCMetadata `xml:"report_metadata"`
 	Policy   DMARCPolicy   `xml:"policy_published"`
 	Records  []DMARCRecord `xml:"record"`
+
+	// how Policy disagrees with our DNS snapshots at the time of the report, if at all
+	PolicyDrift string `xml:"-"`
+	// the hash of the archived original the report was parsed from
+	RawReport string `xml:"-"`
+
+	// set when reprocessing, so the report replaces what was stored from it before
+	replace bool
+	// set when stored by a build, whose single progress bar counts messages, so each report doesn't print its own
+	quiet bool
 }
 
 func parseDMARC(r io.Reader) (*DMARCFeedback, error) {
-	doc, err := xmlquery.Parse(r)
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	// check the limits before building a document from XML anyone can email us
+	if err = checkXML(b); err != nil {
+		return nil, err
+	}
+
+	doc, err := xmlquery.Parse(bytes.NewReader(b))
 	if err != nil {
 		return nil, err
 	}
@@ -75,7 +107,12 @@ func parseDMARC(r io.Reader) (*DMARCFeedback, error) {
 		return nil, err
 	}
 
-	pct, err := strconv.Atoi(policy.SelectElement("pct").InnerText())
+	// a missing (or empty) pct means all mail, as it does in a DMARC record
+	pctVal := getNodeVal(policy, "pct", "100")
+	if pctVal == "" {
+		pctVal = "100"
+	}
+	pct, err := strconv.Atoi(pctVal)
 	if err != nil {
 		return nil, err
 	}
@@ -100,8 +137,12 @@ func parseDMARC(r io.Reader) (*DMARCFeedback, error) {
 	}
 	feedback.Records = make([]DMARCRecord, len(records))
 	for i, node := range records {
-		feedback.Records[i].SourceIP = node.SelectElement("row/source_ip").InnerText()
-		feedback.Records[i].Count, _ = strconv.Atoi(node.SelectElement("row/count").InnerText())
+		sourceIP, err := getNodeElm(node, "row/source_ip")
+		if err != nil {
+			return nil, fmt.Errorf("record %d: %w", i+1, err)
+		}
+		feedback.Records[i].SourceIP = strings.TrimSpace(sourceIP.InnerText())
+		feedback.Records[i].Count, _ = strconv.Atoi(getNodeVal(node, "row/count", "0"))
 		feedback.Records[i].Disposition = getNodeVal(node, "row/policy_evaluated/disposition")
 		feedback.Records[i].DKIM = getNodeVal(node, "row/policy_evaluated/dkim")
 		feedback.Records[i].SPF = getNodeVal(node, "row/policy_evaluated/spf")
@@ -109,9 +150,19 @@ func parseDMARC(r io.Reader) (*DMARCFeedback, error) {
 		feedback.Records[i].ReasonComment = getNodeVal(node, "row/policy_evaluated/reason/comment")
 		feedback.Records[i].EnvelopeTo = getNodeVal(node, "identifiers/envelope_to")
 		feedback.Records[i].HeaderFrom = getNodeVal(node, "identifiers/header_from")
-		feedback.Records[i].DKIMDomain = getNodeVal(node, "auth_results/dkim/domain")
-		feedback.Records[i].DKIMResult = getNodeVal(node, "auth_results/dkim/result")
-		feedback.Records[i].DKIMHResult = getNodeVal(node, "auth_results/dkim/human_result")
+		// a message may carry several DKIM signatures, any of which passing and aligning is enough
+		for _, sig := range node.SelectElements("auth_results/dkim") {
+			feedback.Records[i].DKIMResults = append(feedback.Records[i].DKIMResults, DKIMAuthResult{
+				Domain:      getNodeVal(sig, "domain"),
+				Selector:    getNodeVal(sig, "selector"),
+				Result:      getNodeVal(sig, "result"),
+				HumanResult: getNodeVal(sig, "human_result"),
+			})
+		}
+		feedback.Records[i].DKIMDomain, feedback.Records[i].DKIMResult, feedback.Records[i].DKIMHResult = "NULL", "NULL", "NULL"
+		if sig, _, ok := bestDKIM(feedback.Records[i].DKIMResults, fromDomain(feedback, feedback.Records[i])); ok {
+			feedback.Records[i].DKIMDomain, feedback.Records[i].DKIMResult, feedback.Records[i].DKIMHResult = sig.Domain, sig.Result, sig.HumanResult
+		}
 		feedback.Records[i].SPFDomain = getNodeVal(node, "auth_results/spf/domain")
 		feedback.Records[i].SPFResult = getNodeVal(node, "auth_results/spf/result")
 	}
@@ -119,10 +170,54 @@ func parseDMARC(r io.Reader) (*DMARCFeedback, error) {
 	return feedback, nil
 }
 
+// scans a report's XML, failing if it's nested deeper than `maxXMLDepth` or has more than `maxReportRecords` records
+func checkXML(b []byte) error {
+	var (
+		dec      = xml.NewDecoder(bytes.NewReader(b))
+		maxDepth = viper.GetInt("maxXMLDepth")
+		maxRecs  = viper.GetInt("maxReportRecords")
+		depth    = 0
+		records  = 0
+	)
+	// only the structure is checked, leaving the parser to be as lenient with charsets and entities as ever
+	dec.Strict = false
+	dec.CharsetReader = func(charset string, input io.Reader) (io.Reader, error) { return input, nil }
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			if depth++; depth > maxDepth {
+				return limitError(fmt.Sprintf("Report is nested deeper than maxXMLDepth (%d)", maxDepth))
+			}
+			if t.Name.Local == "record" && depth == 2 {
+				if records++; records > maxRecs {
+					return limitError(fmt.Sprintf("Report has more than maxReportRecords (%d) records", maxRecs))
+				}
+			}
+		case xml.EndElement:
+			depth--
+		}
+	}
+}
+
+// missingFieldError is a report without an element it can't be stored without
+type missingFieldError struct {
+	path string
+}
+
+func (e missingFieldError) Error() string {
+	return fmt.Sprintf("Report doesn't contain required \"%s\"", e.path)
+}
+
 func getNodeElm(n *xmlquery.Node, path string) (node *xmlquery.Node, err error) {
 	node = n.SelectElement(path)
 	if node == nil {
-		err = fmt.Errorf("Report doesn't contain required \"%s\"", path)
+		err = missingFieldError{path}
 	}
 	return
 }
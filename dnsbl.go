@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/spf13/viper"
+)
+
+// a cached DNSBL result for a single source IP
+type dnsblEntry struct {
+	Lists   []string `json:"lists"`
+	Expires int64    `json:"expires"`
+}
+
+// reports whether a record failed both SPF and DKIM policy evaluation
+func failsAuth(record DMARCRecord) bool {
+	return record.SPF != "pass" && record.DKIM != "pass"
+}
+
+// builds the DNSBL query name for ip in zone, i.e. 4.3.2.1.zen.spamhaus.org for 1.2.3.4
+func dnsblQuery(ip net.IP, zone string) string {
+	var labels []string
+	if ip4 := ip.To4(); ip4 != nil {
+		for i := len(ip4) - 1; i >= 0; i-- {
+			labels = append(labels, fmt.Sprintf("%d", ip4[i]))
+		}
+	} else {
+		// IPv6 addresses are queried nibble by nibble, per RFC 5782 section 2.4
+		for i := len(ip) - 1; i >= 0; i-- {
+			labels = append(labels, fmt.Sprintf("%x.%x", ip[i]&0x0f, ip[i]>>4))
+		}
+	}
+	return strings.Join(labels, ".") + "." + strings.TrimSuffix(zone, ".")
+}
+
+// queries each configured blocklist for ip, returning the zones it is listed on and the zones which couldn't
+// say (i.e. timed out or failed), since only NXDOMAIN means it isn't listed
+func queryDNSBL(ctx context.Context, ip string) (listed []string, unknown []string, err error) {
+	listed = []string{}
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return listed, nil, nil
+	}
+
+	for _, zone := range viper.GetStringSlice("dnsbl") {
+		ctx, cancel := context.WithTimeout(ctx, viper.GetDuration("dnsblTimeout"))
+		answers, lookupErr := defaultResoler.LookupHost(ctx, dnsblQuery(addr, zone))
+		cancel()
+		if isNotFound(lookupErr) {
+			continue
+		} else if lookupErr != nil {
+			unknown = append(unknown, zone)
+			err = lookupErr
+			continue
+		}
+		for _, a := range answers {
+			// listings are returned as 127.0.0.0/8, but 127.255.255.0/24 signals a refused query
+			if strings.HasPrefix(a, "127.") && !strings.HasPrefix(a, "127.255.255.") {
+				listed = append(listed, zone)
+				break
+			}
+		}
+	}
+	return listed, unknown, err
+}
+
+// lookup which blocklists an IP address is on, cached in boltdb until the entry expires. Listings which
+// couldn't all be checked aren't cached, and the zones left unknown are returned with the last error
+func lookupDNSBL(ctx context.Context, ip string) ([]string, []string, error) {
+	if len(viper.GetStringSlice("dnsbl")) == 0 {
+		return nil, nil, nil
+	}
+
+	var entry dnsblEntry
+	bdb.View(func(tx *bolt.Tx) error {
+		if v := tx.Bucket([]byte("dnsbl-cache")).Get([]byte(ip)); v != nil {
+			return json.Unmarshal(v, &entry)
+		}
+		return nil
+	})
+	if entry.Expires > time.Now().Unix() {
+		return entry.Lists, nil, nil
+	}
+
+	listed, unknown, err := queryDNSBL(ctx, ip)
+	// don't cache listings which were cut short or incomplete
+	if ctx.Err() != nil || len(unknown) > 0 {
+		return listed, unknown, err
+	}
+	entry = dnsblEntry{
+		Lists:   listed,
+		Expires: time.Now().Add(viper.GetDuration("dnsblTTL")).Unix(),
+	}
+	bdb.Update(func(tx *bolt.Tx) error {
+		v, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		return tx.Bucket([]byte("dnsbl-cache")).Put([]byte(ip), v)
+	})
+	return entry.Lists, nil, nil
+}
+
+// dnsblEnricher lists the blocklists a source is on, for sources which failed both SPF and DKIM
+type dnsblEnricher struct{}
+
+func (dnsblEnricher) Name() string { return "dnsbl" }
+
+func (dnsblEnricher) Network() bool { return true }
+
+func (dnsblEnricher) Enrich(ctx context.Context, report *DMARCFeedback, record DMARCRecord, attrs Attributes) (Attributes, error) {
+	if !failsAuth(record) {
+		return nil, nil
+	}
+	listed, unknown, err := lookupDNSBL(ctx, record.SourceIP)
+	out := Attributes{"dnsbl": strings.Join(listed, ",")}
+	if len(unknown) > 0 {
+		// the zones which couldn't say are unknown, rather than taken to not list the source
+		out["dnsbl_unknown"] = strings.Join(unknown, ",")
+		return out, fmt.Errorf("couldn't check %s on %s: %s", record.SourceIP, out["dnsbl_unknown"], err)
+	}
+	return out, ctx.Err()
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/spf13/viper"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// serves DNS over UDP on a local port, answering each A query with the addresses in answers, NXDOMAIN for names
+// not in it, and nothing at all for names under a zone in drop (i.e. a blocklist which times out)
+func dnsStandIn(t *testing.T, answers map[string]string, drop ...string) string {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			var msg dnsmessage.Message
+			if msg.Unpack(buf[:n]) != nil || len(msg.Questions) == 0 {
+				continue
+			}
+			q := msg.Questions[0]
+			name := strings.TrimSuffix(q.Name.String(), ".")
+
+			dropped := false
+			for _, zone := range drop {
+				dropped = dropped || strings.HasSuffix(name, "."+zone)
+			}
+			if dropped {
+				continue
+			}
+
+			msg.Header.Response, msg.Header.RecursionAvailable = true, true
+			answer, ok := answers[name]
+			switch {
+			case !ok:
+				msg.Header.RCode = dnsmessage.RCodeNameError
+			case q.Type == dnsmessage.TypeA:
+				var a [4]byte
+				copy(a[:], net.ParseIP(answer).To4())
+				msg.Answers = []dnsmessage.Resource{{
+					Header: dnsmessage.ResourceHeader{Name: q.Name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: 60},
+					Body:   &dnsmessage.AResource{A: a},
+				}}
+			}
+			if b, err := msg.Pack(); err == nil {
+				conn.WriteTo(b, addr)
+			}
+		}
+	}()
+	return conn.LocalAddr().String()
+}
+
+// opens a throwaway bolt database with the buckets dmarcdb creates
+func testBolt(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dmarcdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	if bdb, err = bolt.Open(filepath.Join(dir, "test.db"), 0600, nil); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { bdb.Close() })
+	err = bdb.Update(func(tx *bolt.Tx) error {
+		for _, b := range []string{"dnsbl-cache", "hosts-cache", "processed-fail"} {
+			if _, err := tx.CreateBucketIfNotExists([]byte(b)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLookupDNSBL(t *testing.T) {
+	testBolt(t)
+	server := dnsStandIn(t, map[string]string{
+		"2.0.0.127.listed.test":  "127.0.0.2",
+		"2.0.0.127.refused.test": "127.255.255.254",
+	}, "slow.test")
+
+	viper.Set("dns", server)
+	viper.Set("dnsblTimeout", 200*time.Millisecond)
+	viper.Set("dnsblTTL", time.Hour)
+	defer viper.Set("dns", nil)
+	defer func(r *net.Resolver) { defaultResoler = r }(defaultResoler)
+	defaultResoler = dnsResolver()
+
+	cached := func(ip string) bool {
+		var found bool
+		bdb.View(func(tx *bolt.Tx) error {
+			found = tx.Bucket([]byte("dnsbl-cache")).Get([]byte(ip)) != nil
+			return nil
+		})
+		return found
+	}
+
+	tests := []struct {
+		name          string
+		zones         []string
+		ip            string
+		listed        []string
+		unknown       []string
+		shouldBeCache bool
+	}{
+		{"listed", []string{"listed.test"}, "127.0.0.2", []string{"listed.test"}, nil, true},
+		{"nxdomain", []string{"listed.test", "clean.test"}, "127.0.0.3", []string{}, nil, true},
+		{"refused", []string{"refused.test"}, "127.0.0.2", []string{}, nil, true},
+		{"timeout", []string{"listed.test", "slow.test"}, "127.0.0.4", []string{}, []string{"slow.test"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			viper.Set("dnsbl", tt.zones)
+			bdb.Update(func(tx *bolt.Tx) error { return tx.Bucket([]byte("dnsbl-cache")).Delete([]byte(tt.ip)) })
+
+			listed, unknown, err := lookupDNSBL(context.Background(), tt.ip)
+			if !reflect.DeepEqual(listed, tt.listed) {
+				t.Errorf("listed = %v, want %v", listed, tt.listed)
+			}
+			if !reflect.DeepEqual(unknown, tt.unknown) {
+				t.Errorf("unknown = %v, want %v", unknown, tt.unknown)
+			}
+			if (err != nil) != (tt.unknown != nil) {
+				t.Errorf("err = %v, want an error only for unknown zones", err)
+			}
+			if cached(tt.ip) != tt.shouldBeCache {
+				t.Errorf("cached = %v, want %v", cached(tt.ip), tt.shouldBeCache)
+			}
+		})
+	}
+}
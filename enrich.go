@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"crypto/sha1"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// Attributes are the named values an Enricher adds to a record
+type Attributes map[string]string
+
+// Enricher adds attributes to a record, i.e. where its source IP is or what it's named
+type Enricher interface {
+	// Name identifies the enricher in the `enrichers` config and the record_attributes table
+	Name() string
+	// Network reports whether the enricher needs the network, so it can be skipped when offline
+	Network() bool
+	// Enrich returns the attributes for record, given the report it's from and the attributes of earlier enrichers
+	Enrich(ctx context.Context, report *DMARCFeedback, record DMARCRecord, attrs Attributes) (Attributes, error)
+}
+
+// enrichment is the output of a single enricher for a record
+type enrichment struct {
+	Enricher string
+	Attrs    Attributes
+	Err      error
+}
+
+// all available enrichers, run in the order configured in `enrichers`
+var enrichers = map[string]Enricher{
+	"geoip":     geoipEnricher{},
+	"hostname":  hostnameEnricher{},
+	"sender":    senderEnricher{},
+	"dnsbl":     dnsblEnricher{},
+	"spf":       spfEnricher{},
+	"alignment": alignmentEnricher{},
+}
+
+// runs the configured enrichers over record in order, returning the merged attributes and each enricher's output
+func enrich(ctx context.Context, report *DMARCFeedback, record DMARCRecord) (Attributes, []enrichment) {
+	var (
+		attrs   = Attributes{}
+		results []enrichment
+	)
+	for _, name := range viper.GetStringSlice("enrichers") {
+		e, ok := enrichers[name]
+		// when offline, network enrichers are left for a later `dmarcdb reenrich --pending`
+		if !ok || (e.Network() && viper.GetBool("offline")) {
+			continue
+		}
+
+		out, err := runEnricher(ctx, e, report, record, attrs)
+		if err != nil {
+			devLogger(fmt.Sprintf("enricher %s failed for %s: %s", name, record.SourceIP, err))
+		}
+		for k, v := range out {
+			attrs[k] = v
+		}
+		results = append(results, enrichment{name, out, err})
+	}
+	return attrs, results
+}
+
+// reports whether records enriched now will be missing the output of a skipped network enricher
+func enrichPending() bool {
+	if !viper.GetBool("offline") {
+		return false
+	}
+	for _, name := range viper.GetStringSlice("enrichers") {
+		if e, ok := enrichers[name]; ok && e.Network() {
+			return true
+		}
+	}
+	return false
+}
+
+// runs a single enricher with its timeout, isolating the rest of the pipeline from its errors and panics
+func runEnricher(ctx context.Context, e Enricher, report *DMARCFeedback, record DMARCRecord, attrs Attributes) (Attributes, error) {
+	ctx, cancel := context.WithTimeout(ctx, enricherTimeout(e.Name()))
+	defer cancel()
+
+	// enrichers get their own copy of the attributes so they can't race with the pipeline on timeout
+	prior := make(Attributes, len(attrs))
+	for k, v := range attrs {
+		prior[k] = v
+	}
+
+	done := make(chan enrichment, 1)
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				done <- enrichment{Err: fmt.Errorf("panic: %v", r)}
+			}
+		}()
+		out, err := e.Enrich(ctx, report, record, prior)
+		done <- enrichment{Attrs: out, Err: err}
+	}()
+
+	select {
+	case result := <-done:
+		return result.Attrs, result.Err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// returns the configured timeout for an enricher, i.e. `enricherTimeouts.hostname`, or `enricherTimeout`
+func enricherTimeout(name string) time.Duration {
+	if key := "enricherTimeouts." + name; viper.IsSet(key) {
+		return viper.GetDuration(key)
+	}
+	return viper.GetDuration("enricherTimeout")
+}
+
+// a stable identifier for the i'th record of a report, linking it to its record_attributes
+func (report *DMARCFeedback) recordKey(i int) string {
+	return fmt.Sprintf("%x", sha1.Sum([]byte(fmt.Sprintf("%s\x00%s\x00%d", report.Metadata.OrgName, report.Metadata.ReportID, i))))
+}
+
+// returns an attribute as an integer, or NULL if the enricher didn't set it
+func (attrs Attributes) intValue(key string) interface{} {
+	n, err := strconv.ParseInt(attrs[key], 10, 64)
+	if err != nil {
+		return nil
+	}
+	return n
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+// how deep archives are unpacked inside each other, i.e. a gzip'd zip of reports
+const maxArchiveNesting = 3
+
+// limitError is an attachment or report going over one of the limits on what's ingested, i.e. maxReportSize
+type limitError string
+
+func (e limitError) Error() string { return string(e) }
+
+// reportMember is a report's XML found in an attachment, i.e. one file of a zip
+type reportMember struct {
+	Name string
+	Data []byte
+}
+
+// what's left of the limits on unpacking a single attachment, which anyone can email us
+type extraction struct {
+	// bytes left to decompress
+	budget uint
+	// archive entries left to look at
+	entries int
+}
+
+// finds every report XML in an attachment by its content rather than its name, unpacking
+// gzip, zip and tar archives up to `maxReportSize` bytes and `maxArchiveEntries` entries in total
+func extractReports(name string, b []byte) ([]reportMember, error) {
+	if max := viper.GetSizeInBytes("maxAttachmentSize"); uint(len(b)) > max {
+		return nil, limitError(fmt.Sprintf("%s is larger than maxAttachmentSize (%d bytes)", name, max))
+	}
+
+	ex := &extraction{
+		budget:  viper.GetSizeInBytes("maxReportSize"),
+		entries: viper.GetInt("maxArchiveEntries"),
+	}
+	members, err := ex.members(name, b, 0)
+	if err != nil {
+		return nil, err
+	}
+	if len(members) == 0 {
+		return nil, fmt.Errorf("no XML report in %s", name)
+	}
+	return members, nil
+}
+
+// detects the format of an attachment from its leading bytes
+func detectFormat(b []byte) string {
+	switch {
+	case bytes.HasPrefix(b, []byte{0x1f, 0x8b}):
+		return "gzip"
+	case bytes.HasPrefix(b, []byte("PK\x03\x04")), bytes.HasPrefix(b, []byte("PK\x05\x06")):
+		return "zip"
+	case len(b) > 262 && bytes.HasPrefix(b[257:], []byte("ustar")):
+		return "tar"
+	}
+	// XML may start with a byte order mark and whitespace before its declaration or root element
+	text := bytes.TrimLeft(bytes.TrimPrefix(b, []byte("\xef\xbb\xbf")), " \t\r\n")
+	if bytes.HasPrefix(text, []byte("<")) {
+		return "xml"
+	}
+	return ""
+}
+
+func (ex *extraction) members(name string, b []byte, depth int) ([]reportMember, error) {
+	format := detectFormat(b)
+	if format != "xml" && format != "" && depth >= maxArchiveNesting {
+		return nil, limitError(fmt.Sprintf("%s is nested more than %d archives deep", name, maxArchiveNesting))
+	}
+
+	switch format {
+	case "xml":
+		return []reportMember{{name, b}}, nil
+	case "gzip":
+		gz, err := gzip.NewReader(bytes.NewReader(b))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		defer gz.Close()
+		data, err := ex.read(gz)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		inner := strings.TrimSuffix(strings.TrimSuffix(name, ".gz"), ".gzip")
+		if gz.Name != "" {
+			inner = gz.Name
+		}
+		return ex.members(inner, data, depth+1)
+	case "zip":
+		zr, err := zip.NewReader(bytes.NewReader(b), int64(len(b)))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		var members []reportMember
+		for _, f := range zr.File {
+			if err = ex.entry(f.Name); err != nil {
+				return nil, fmt.Errorf("%s: %w", name, err)
+			}
+			if f.FileInfo().IsDir() {
+				continue
+			}
+			rc, err := f.Open()
+			if err != nil {
+				return nil, fmt.Errorf("%s member %s: %w", name, f.Name, err)
+			}
+			data, err := ex.read(rc)
+			rc.Close()
+			if err != nil {
+				return nil, fmt.Errorf("%s member %s: %w", name, f.Name, err)
+			}
+			found, err := ex.archiveMembers(f.Name, data, depth)
+			if err != nil {
+				return nil, fmt.Errorf("%s member %w", name, err)
+			}
+			members = append(members, found...)
+		}
+		return members, nil
+	case "tar":
+		var (
+			tr      = tar.NewReader(bytes.NewReader(b))
+			members []reportMember
+		)
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				return members, nil
+			} else if err != nil {
+				return nil, fmt.Errorf("%s: %w", name, err)
+			}
+			if err = ex.entry(hdr.Name); err != nil {
+				return nil, fmt.Errorf("%s: %w", name, err)
+			}
+			if hdr.Typeflag != tar.TypeReg && hdr.Typeflag != tar.TypeRegA {
+				continue
+			}
+			data, err := ex.read(tr)
+			if err != nil {
+				return nil, fmt.Errorf("%s member %s: %w", name, hdr.Name, err)
+			}
+			found, err := ex.archiveMembers(hdr.Name, data, depth)
+			if err != nil {
+				return nil, fmt.Errorf("%s member %w", name, err)
+			}
+			members = append(members, found...)
+		}
+	default:
+		return nil, fmt.Errorf("%s isn't a gzip, zip or XML report", name)
+	}
+}
+
+// extracts the reports of an archive member, skipping anything which isn't a report or archive (i.e. a readme)
+func (ex *extraction) archiveMembers(name string, data []byte, depth int) ([]reportMember, error) {
+	if detectFormat(data) == "" {
+		devLogger("skipping archive member " + name)
+		return nil, nil
+	}
+	return ex.members(path.Clean(name), data, depth+1)
+}
+
+// counts an archive entry against `maxArchiveEntries`, rejecting names which would escape the directory
+// they're extracted to (nothing is extracted to disk, but no reporter has a reason to send them)
+func (ex *extraction) entry(name string) error {
+	if ex.entries--; ex.entries < 0 {
+		return limitError(fmt.Sprintf("more than maxArchiveEntries (%d) archive entries", viper.GetInt("maxArchiveEntries")))
+	}
+	slashed := strings.Replace(name, "\\", "/", -1)
+	if path.IsAbs(slashed) || (len(slashed) > 1 && slashed[1] == ':') {
+		return fmt.Errorf("archive entry %q has an absolute path", name)
+	}
+	for _, elem := range strings.Split(slashed, "/") {
+		if elem == ".." {
+			return fmt.Errorf("archive entry %q has a path outside the archive", name)
+		}
+	}
+	return nil
+}
+
+// reads r whole, failing rather than reading past what's left of the decompression budget
+func (ex *extraction) read(r io.Reader) ([]byte, error) {
+	data, err := ioutil.ReadAll(io.LimitReader(r, int64(ex.budget)+1))
+	if err != nil {
+		return nil, err
+	}
+	if uint(len(data)) > ex.budget {
+		return nil, limitError(fmt.Sprintf("decompresses to more than maxReportSize (%d bytes)", viper.GetSizeInBytes("maxReportSize")))
+	}
+	ex.budget -= uint(len(data))
+	return data, nil
+}
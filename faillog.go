@@ -0,0 +1,256 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/go-ole/go-ole/oleutil"
+)
+
+// finds the reporter of a report which couldn't be parsed, if its XML gets that far
+var orgNamePattern = regexp.MustCompile(`<org_name>\s*([^<]+?)\s*</org_name>`)
+
+// failure is an entry of the "processed-fail" bucket, keyed by the EntryID of a message whose reports couldn't be stored
+type failure struct {
+	MessageID   string    `json:"message_id"`
+	Subject     string    `json:"subject"`
+	Sender      string    `json:"sender"`
+	Attachment  string    `json:"attachment"`
+	Member      string    `json:"member,omitempty"`
+	Archive     string    `json:"archive,omitempty"`
+	Reporter    string    `json:"reporter,omitempty"`
+	Class       string    `json:"class"`
+	Error       string    `json:"error"`
+	FirstFailed time.Time `json:"first_failed"`
+	LastFailed  time.Time `json:"last_failed"`
+	Attempts    int       `json:"attempts"`
+}
+
+// sorts an ingestion error into the class it's logged under
+func failureClass(r *rawReport, err error) string {
+	var (
+		limit   limitError
+		syntax  *xml.SyntaxError
+		missing missingFieldError
+	)
+	switch {
+	case errors.As(err, &limit):
+		return "limit"
+	case r.Err != nil:
+		return "attachment"
+	case errors.As(err, &syntax):
+		return "xml"
+	case errors.As(err, &missing):
+		return "missing-field"
+	default:
+		return "invalid-report"
+	}
+}
+
+// logs a report of a message which couldn't be extracted or parsed, counting the attempts at it so far
+func recordFailure(job *mailJob, r *rawReport, err error) error {
+	now := time.Now()
+	f := failure{
+		MessageID:   job.id,
+		Subject:     job.subject,
+		Sender:      job.sender,
+		Attachment:  r.Filename,
+		Member:      r.Member,
+		Archive:     r.Hash,
+		Class:       failureClass(r, err),
+		Error:       err.Error(),
+		FirstFailed: now,
+		LastFailed:  now,
+		Attempts:    1,
+	}
+	if m := orgNamePattern.FindSubmatch(r.Data); m != nil {
+		f.Reporter = string(m[1])
+	}
+
+	return bdb.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("processed-fail"))
+		if prev, ok := parseFailure([]byte(job.id), b.Get([]byte(job.id))); ok {
+			f.FirstFailed = prev.FirstFailed
+			f.Attempts = prev.Attempts + 1
+		}
+		v, err := json.Marshal(f)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(job.id), v)
+	})
+}
+
+// reads a fail log entry, including the bare error strings logged before entries were structured
+func parseFailure(k, v []byte) (failure, bool) {
+	var f failure
+	if v == nil {
+		return f, false
+	}
+	if err := json.Unmarshal(v, &f); err != nil {
+		f = failure{MessageID: string(k), Class: "unknown", Error: string(v), Attempts: 1}
+	}
+	return f, true
+}
+
+// loads the fail log entries matching the --since and --reporter filters, oldest first
+func loadFailures(since time.Time, reporter string) ([]failure, error) {
+	var fails []failure
+	err := bdb.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte("processed-fail")).ForEach(func(k, v []byte) error {
+			f, _ := parseFailure(k, v)
+			if f.LastFailed.Before(since) {
+				return nil
+			}
+			if reporter != "" && !strings.Contains(strings.ToLower(f.Reporter+" "+f.Sender), strings.ToLower(reporter)) {
+				return nil
+			}
+			fails = append(fails, f)
+			return nil
+		})
+	})
+	sort.Slice(fails, func(i, j int) bool { return fails[i].LastFailed.Before(fails[j].LastFailed) })
+	return fails, err
+}
+
+// handles `dmarcdb logs [--json] [--since 30d] [--reporter google.com]`
+func logs(args ...string) error {
+	var (
+		flags    = flag.NewFlagSet("logs", flag.ContinueOnError)
+		asJSON   = flags.Bool("json", false, "print each failure as JSON")
+		since    = flags.String("since", "", "only failures since, i.e. 30d or 2018-01-31")
+		reporter = flags.String("reporter", "", "only failures from reporters or senders containing this")
+	)
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	sinceTime, err := parseSince(*since)
+	if err != nil {
+		return err
+	}
+
+	fails, err := loadFailures(sinceTime, *reporter)
+	if err != nil {
+		return err
+	}
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(fails)
+	}
+
+	// group identical failures from the same reporter, so we know who to harass about what
+	type group struct {
+		class, from, err string
+	}
+	var (
+		counts = map[group]int{}
+		groups []group
+	)
+	for _, f := range fails {
+		from := f.Reporter
+		if from == "" {
+			from = f.Sender
+		}
+		g := group{f.Class, from, f.Error}
+		if counts[g] == 0 {
+			groups = append(groups, g)
+		}
+		counts[g]++
+	}
+	sort.SliceStable(groups, func(i, j int) bool { return counts[groups[i]] > counts[groups[j]] })
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "COUNT\tCLASS\tFROM\tERROR")
+	for _, g := range groups {
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\n", counts[g], g.class, g.from, g.err)
+	}
+	return w.Flush()
+}
+
+// handles `dmarcdb retry-failed [--since 30d] [--reporter google.com]`, reprocessing logged failures after a fix
+// from their messages in Outlook, or from their archived originals when the message is gone
+func retryFailed(ctx context.Context, args ...string) error {
+	var (
+		flags    = flag.NewFlagSet("retry-failed", flag.ContinueOnError)
+		since    = flags.String("since", "", "only retry failures since, i.e. 30d or 2018-01-31")
+		reporter = flags.String("reporter", "", "only retry failures from reporters or senders containing this")
+	)
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	sinceTime, err := parseSince(*since)
+	if err != nil {
+		return err
+	}
+
+	fails, err := loadFailures(sinceTime, *reporter)
+	if err != nil {
+		return err
+	}
+
+	var (
+		ns      = oleutil.MustCallMethod(outlook, "GetNamespace", "MAPI").ToIDispatch()
+		fixed   = 0
+		skipped = 0
+	)
+	for _, f := range fails {
+		if err = ctx.Err(); err != nil {
+			break
+		}
+
+		var result mailResult
+		item, itemErr := oleutil.CallMethod(ns, "GetItemFromID", f.MessageID)
+		switch {
+		case itemErr == nil:
+			var job *mailJob
+			if job, err = newMailJob(item.ToIDispatch()); err != nil {
+				return err
+			}
+			job.replace = true
+			result = job.process(ctx)
+		case f.Archive != "":
+			if err = reprocessArchived(ctx, f.Archive); err != nil {
+				fmt.Printf("Still failing %s from %s: %s\n", f.Attachment, f.Sender, err)
+				err = nil
+				continue
+			}
+		default:
+			fmt.Printf("Skipping %s from %s, the message and its original are gone\n", f.Attachment, f.Sender)
+			skipped++
+			continue
+		}
+		if result.err != nil {
+			return fmt.Errorf("retrying %s from %s: %s", f.Attachment, f.Sender, result.err)
+		}
+		if result.failed {
+			continue
+		}
+
+		// the message is done now, so it isn't built again or retried
+		err = bdb.Update(func(tx *bolt.Tx) error {
+			if err := tx.Bucket([]byte("processed-fail")).Delete([]byte(f.MessageID)); err != nil {
+				return err
+			}
+			return tx.Bucket([]byte("processed-mail")).Put([]byte(f.MessageID), []byte{1})
+		})
+		if err != nil {
+			return err
+		}
+		fixed++
+	}
+
+	fmt.Printf("Retried %d failures: %d fixed, %d skipped, %d still failing\n", len(fails), fixed, skipped, len(fails)-fixed-skipped)
+	return err
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+func TestFailureClass(t *testing.T) {
+	viper.Set("maxAttachmentSize", "1MB")
+	viper.Set("maxReportSize", "64")
+	viper.Set("maxArchiveEntries", 10)
+	viper.Set("maxXMLDepth", 4)
+	viper.Set("maxReportRecords", 10)
+	defer func() {
+		for _, key := range []string{"maxAttachmentSize", "maxReportSize", "maxArchiveEntries", "maxXMLDepth", "maxReportRecords"} {
+			viper.Set(key, nil)
+		}
+	}()
+
+	var gz bytes.Buffer
+	w := gzip.NewWriter(&gz)
+	w.Write(bytes.Repeat([]byte("<feedback/>"), 100))
+	w.Close()
+	_, tooLarge := extractReports("report.xml.gz", gz.Bytes())
+	_, notReport := extractReports("report.pdf", []byte("%PDF-1.4"))
+	tooDeep := checkXML([]byte("<a><b><c><d><e/></d></c></b></a>"))
+	syntax := checkXML([]byte("<feedback><record"))
+	for _, err := range []error{tooLarge, notReport, tooDeep, syntax} {
+		if err == nil {
+			t.Fatal("expected an error to classify")
+		}
+	}
+
+	tests := []struct {
+		name  string
+		r     *rawReport
+		err   error
+		class string
+	}{
+		{"decompressed too large", &rawReport{Err: tooLarge}, tooLarge, "limit"},
+		{"nested too deep", &rawReport{}, fmt.Errorf("report.xml: %w", tooDeep), "limit"},
+		{"not a report", &rawReport{Err: notReport}, notReport, "attachment"},
+		{"syntax error", &rawReport{}, fmt.Errorf("report.xml: %w", syntax), "xml"},
+		{"missing field", &rawReport{}, fmt.Errorf("record 2: %w", missingFieldError{"row/source_ip"}), "missing-field"},
+		// a message mentioning a limit isn't one
+		{"invalid", &rawReport{}, errors.New("date is later than maximum"), "invalid-report"},
+	}
+	for _, tt := range tests {
+		if got := failureClass(tt.r, tt.err); got != tt.class {
+			t.Errorf("%s: failureClass(%q) = %s, want %s", tt.name, tt.err, got, tt.class)
+		}
+	}
+}
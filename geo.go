@@ -0,0 +1,303 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/oschwald/geoip2-golang"
+	"github.com/spf13/viper"
+)
+
+var geoDB = &geoDatabases{}
+
+// geoDatabases holds the GeoLite2 city and ASN readers, which can be swapped atomically while in use
+type geoDatabases struct {
+	mu      sync.RWMutex
+	city    *geoip2.Reader
+	asn     *geoip2.Reader
+	modTime map[string]time.Time
+}
+
+// geoResult is what the GeoIP databases know about a source IP
+type geoResult struct {
+	Location string
+	ASN      uint
+	ASNOrg   string
+	Build    int64
+}
+
+// (re)opens the configured GeoIP databases, replacing the current readers only if both open successfully
+func (g *geoDatabases) open() error {
+	var (
+		paths   = []string{viper.GetString("geocitydb"), viper.GetString("geoasndb")}
+		readers = make([]*geoip2.Reader, len(paths))
+		modTime = map[string]time.Time{}
+	)
+	for i, p := range paths {
+		// read the whole file rather than memory mapping it, so it isn't locked against being replaced
+		b, err := ioutil.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		if readers[i], err = geoip2.FromBytes(b); err != nil {
+			return fmt.Errorf("%s: %s", p, err)
+		}
+		if info, err := os.Stat(p); err == nil {
+			modTime[p] = info.ModTime()
+		}
+	}
+
+	g.mu.Lock()
+	oldCity, oldASN := g.city, g.asn
+	g.city, g.asn, g.modTime = readers[0], readers[1], modTime
+	g.mu.Unlock()
+
+	for _, r := range []*geoip2.Reader{oldCity, oldASN} {
+		if r != nil {
+			r.Close()
+		}
+	}
+	return nil
+}
+
+// looks up the location and autonomous system of ip
+func (g *geoDatabases) lookup(ip net.IP) geoResult {
+	var result geoResult
+	if ip == nil {
+		return result
+	}
+
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+
+	if g.city != nil {
+		result.Build = int64(g.city.Metadata().BuildEpoch)
+		if city, err := g.city.City(ip); err == nil {
+			result.Location = city.Country.IsoCode
+			if len(city.Subdivisions) > 0 {
+				result.Location = fmt.Sprintf("%s/%s", city.Subdivisions[0].IsoCode, city.Country.IsoCode)
+			}
+		}
+	}
+	if g.asn != nil {
+		if asn, err := g.asn.ASN(ip); err == nil {
+			result.ASN = asn.AutonomousSystemNumber
+			result.ASNOrg = asn.AutonomousSystemOrganization
+		}
+	}
+	return result
+}
+
+// geoipEnricher locates a record's source IP and its autonomous system
+type geoipEnricher struct{}
+
+func (geoipEnricher) Name() string { return "geoip" }
+
+func (geoipEnricher) Network() bool { return false }
+
+func (geoipEnricher) Enrich(ctx context.Context, report *DMARCFeedback, record DMARCRecord, attrs Attributes) (Attributes, error) {
+	ip := net.ParseIP(record.SourceIP)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid source IP \"%s\"", record.SourceIP)
+	}
+
+	result := geoDB.lookup(ip)
+	out := Attributes{
+		"location":  result.Location,
+		"asn_org":   result.ASNOrg,
+		"geo_build": strconv.FormatInt(result.Build, 10),
+	}
+	if result.ASN != 0 {
+		out["asn"] = strconv.FormatUint(uint64(result.ASN), 10)
+	}
+	return out, nil
+}
+
+// reports whether either database file has been modified since it was opened
+func (g *geoDatabases) changed() bool {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+
+	for _, p := range []string{viper.GetString("geocitydb"), viper.GetString("geoasndb")} {
+		if info, err := os.Stat(p); err == nil && !info.ModTime().Equal(g.modTime[p]) {
+			return true
+		}
+	}
+	return false
+}
+
+// reloads the databases when their files change, for long running processes. A geoWatchInterval of 0 doesn't watch
+func (g *geoDatabases) watch() {
+	interval := viper.GetDuration("geoWatchInterval")
+	if interval < 0 {
+		log.Printf("Not watching the GeoIP databases, geoWatchInterval %s is negative", interval)
+	}
+	if interval <= 0 {
+		return
+	}
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+
+	for range tick.C {
+		if !g.changed() {
+			continue
+		}
+		if err := g.open(); err != nil {
+			log.Printf("Failed reloading GeoIP databases: %s", err)
+		} else {
+			log.Printf("Reloaded GeoIP databases")
+		}
+	}
+}
+
+// handles `dmarcdb geo [info|update]`
+func geo(args ...string) error {
+	if len(args) == 0 || args[0] == "info" {
+		geoDB.mu.RLock()
+		defer geoDB.mu.RUnlock()
+		for _, r := range []*geoip2.Reader{geoDB.city, geoDB.asn} {
+			meta := r.Metadata()
+			fmt.Printf("%s built %s\n", meta.DatabaseType, time.Unix(int64(meta.BuildEpoch), 0).UTC().Format(time.RFC3339))
+		}
+		return nil
+	}
+
+	switch args[0] {
+	case "update":
+		for edition, dest := range map[string]string{
+			"GeoLite2-City": viper.GetString("geocitydb"),
+			"GeoLite2-ASN":  viper.GetString("geoasndb"),
+		} {
+			if err := updateGeoDB(edition, dest); err != nil {
+				return fmt.Errorf("updating %s: %s", edition, err)
+			}
+		}
+		return geoDB.open()
+	default:
+		return fmt.Errorf("The geo option \"%v\" is not yet available", args[0])
+	}
+}
+
+// downloads an edition's tarball, verifies its checksum and replaces the database file at dest with its .mmdb
+func updateGeoDB(edition, dest string) error {
+	url := geoURL(viper.GetString("geoUpdateURL"), edition)
+	fmt.Printf("Downloading %s\n", edition)
+	tarball, err := download(url)
+	if err != nil {
+		return err
+	}
+
+	if sumURL := viper.GetString("geoChecksumURL"); sumURL != "" {
+		sums, err := download(geoURL(sumURL, edition))
+		if err != nil {
+			return err
+		}
+		// checksum files are formatted like sha256sum output, "<hex>  <filename>"
+		fields := strings.Fields(string(sums))
+		sum := sha256.Sum256(tarball)
+		if len(fields) == 0 || !strings.EqualFold(fields[0], hex.EncodeToString(sum[:])) {
+			return fmt.Errorf("checksum mismatch for %s", redactURL(url))
+		}
+	}
+
+	mmdb, err := extractMMDB(tarball, edition)
+	if err != nil {
+		return err
+	}
+
+	// make sure it's actually the database we expect before replacing the current one
+	r, err := geoip2.FromBytes(mmdb)
+	if err != nil {
+		return err
+	}
+	dbType := r.Metadata().DatabaseType
+	r.Close()
+	if dbType != edition {
+		return fmt.Errorf("downloaded database is %s, not %s", dbType, edition)
+	}
+
+	// write beside the destination and rename over it, so readers never see a partial file
+	tmp, err := ioutil.TempFile(filepath.Dir(dest), edition)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err = tmp.Write(mmdb); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	if err = os.Rename(tmp.Name(), dest); err != nil {
+		return err
+	}
+	fmt.Printf("Updated %s\n", dest)
+	return nil
+}
+
+// fills the {edition} and {license} placeholders of a configured download URL
+func geoURL(url, edition string) string {
+	return strings.NewReplacer("{edition}", edition, "{license}", viper.GetString("geoLicenseKey")).Replace(url)
+}
+
+// strips the query from a download URL, which holds the license key, so it can be shown in errors
+func redactURL(rawURL string) string {
+	return strings.Split(rawURL, "?")[0]
+}
+
+func download(rawURL string) ([]byte, error) {
+	client := http.Client{Timeout: 5 * time.Minute}
+	resp, err := client.Get(rawURL)
+	if err != nil {
+		if urlErr, ok := err.(*url.Error); ok {
+			urlErr.URL = redactURL(urlErr.URL)
+		}
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET %s: %s", redactURL(rawURL), resp.Status)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+// finds the edition's .mmdb file in a MaxMind tarball
+func extractMMDB(tarball []byte, edition string) ([]byte, error) {
+	gz, err := gzip.NewReader(bytes.NewReader(tarball))
+	if err != nil {
+		return nil, err
+	}
+	defer gz.Close()
+
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil, fmt.Errorf("no %s.mmdb in archive", edition)
+		} else if err != nil {
+			return nil, err
+		}
+		if path := filepath.ToSlash(hdr.Name); strings.HasSuffix(path, "/"+edition+".mmdb") || path == edition+".mmdb" {
+			return ioutil.ReadAll(tr)
+		}
+	}
+}
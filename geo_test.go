@@ -0,0 +1,186 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/oschwald/geoip2-golang"
+	"github.com/spf13/viper"
+)
+
+// builds an empty MaxMind database of the given type, which is just its metadata
+func testMMDB(dbType string) []byte {
+	str := func(s string) []byte { return append([]byte{0x40 | byte(len(s))}, s...) }
+	// an empty search tree and the data section separator
+	buf := make([]byte, 16)
+	buf = append(buf, "\xab\xcd\xefMaxMind.com"...)
+	buf = append(buf, 0xe0|5)
+	buf = append(append(buf, str("node_count")...), 0xc0)
+	buf = append(append(buf, str("record_size")...), 0xa1, 24)
+	buf = append(append(buf, str("ip_version")...), 0xa1, 4)
+	buf = append(append(buf, str("database_type")...), str(dbType)...)
+	buf = append(append(buf, str("build_epoch")...), 0x04, 0x02, 0x5a, 0x00, 0x00, 0x00)
+	return buf
+}
+
+// wraps an .mmdb in a tarball laid out like MaxMind's downloads
+func testTarball(t *testing.T, edition string, mmdb []byte) []byte {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	name := edition + "_20180102/" + edition + ".mmdb"
+	if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(mmdb))}); err != nil {
+		t.Fatal(err)
+	}
+	tw.Write(mmdb)
+	tw.Close()
+	gz.Close()
+	return buf.Bytes()
+}
+
+func TestUpdateGeoDB(t *testing.T) {
+	const license = "s3cr3t-license"
+	var (
+		city    = testTarball(t, "GeoLite2-City", testMMDB("GeoLite2-City"))
+		asn     = testTarball(t, "GeoLite2-ASN", testMMDB("GeoLite2-ASN"))
+		sum     = sha256.Sum256(city)
+		citySum = hex.EncodeToString(sum[:]) + "  GeoLite2-City.tar.gz\n"
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("license_key") != license {
+			http.Error(w, "invalid license key", http.StatusUnauthorized)
+			return
+		}
+		switch r.URL.Path + "/" + r.URL.Query().Get("edition_id") {
+		case "/db/GeoLite2-City":
+			w.Write(city)
+		case "/db/GeoLite2-ASN":
+			w.Write(asn)
+		case "/sum/GeoLite2-City":
+			w.Write([]byte(citySum))
+		case "/sum/GeoLite2-ASN":
+			w.Write([]byte(strings.Repeat("0", 64) + "  GeoLite2-ASN.tar.gz\n"))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "dmarcdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	defer viper.Set("geoLicenseKey", nil)
+	defer viper.Set("geoChecksumURL", nil)
+	viper.Set("geoUpdateURL", server.URL+"/db?edition_id={edition}&license_key={license}")
+	defer viper.Set("geoUpdateURL", nil)
+
+	tests := []struct {
+		name    string
+		edition string
+		license string
+		sumURL  string
+		err     string
+	}{
+		{"verified", "GeoLite2-City", license, server.URL + "/sum?edition_id={edition}&license_key={license}", ""},
+		{"unverified", "GeoLite2-City", license, "", ""},
+		{"checksum mismatch", "GeoLite2-ASN", license, server.URL + "/sum?edition_id={edition}&license_key={license}", "checksum mismatch"},
+		{"bad license", "GeoLite2-City", "wrong-" + license, "", "401"},
+		{"unreachable", "GeoLite2-City", license, "", "connect"},
+		{"wrong edition", "GeoLite2-Country", license, "", "404"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			viper.Set("geoLicenseKey", tt.license)
+			viper.Set("geoChecksumURL", tt.sumURL)
+			if tt.name == "unreachable" {
+				// a port nothing listens on, so the error comes from the client rather than the response
+				viper.Set("geoUpdateURL", "http://127.0.0.1:1/db?edition_id={edition}&license_key={license}")
+				defer viper.Set("geoUpdateURL", server.URL+"/db?edition_id={edition}&license_key={license}")
+			}
+			dest := filepath.Join(dir, tt.edition+".mmdb")
+			os.Remove(dest)
+
+			err := updateGeoDB(tt.edition, dest)
+			if tt.err == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				b, err := ioutil.ReadFile(dest)
+				if err != nil {
+					t.Fatal(err)
+				}
+				r, err := geoip2.FromBytes(b)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer r.Close()
+				if r.Metadata().DatabaseType != tt.edition {
+					t.Errorf("installed %s, want %s", r.Metadata().DatabaseType, tt.edition)
+				}
+				return
+			}
+
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Fatalf("err = %v, want one containing %q", err, tt.err)
+			}
+			if strings.Contains(err.Error(), license) {
+				t.Errorf("err %q leaks the license key", err)
+			}
+			if _, statErr := os.Stat(dest); !os.IsNotExist(statErr) {
+				t.Errorf("%s was installed despite the error", dest)
+			}
+		})
+	}
+}
+
+func TestUpdateGeoDBWrongType(t *testing.T) {
+	asn := testTarball(t, "GeoLite2-City", testMMDB("GeoLite2-ASN"))
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(asn)
+	}))
+	defer server.Close()
+
+	viper.Set("geoUpdateURL", server.URL)
+	defer viper.Set("geoUpdateURL", nil)
+	dir, err := ioutil.TempDir("", "dmarcdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	err = updateGeoDB("GeoLite2-City", filepath.Join(dir, "GeoLite2-City.mmdb"))
+	if err == nil || !strings.Contains(err.Error(), "is GeoLite2-ASN") {
+		t.Errorf("err = %v, want the database type rejected", err)
+	}
+}
+
+func TestGeoWatchDisabled(t *testing.T) {
+	for _, interval := range []string{"0", "-1m"} {
+		viper.Set("geoWatchInterval", interval)
+		done := make(chan struct{})
+		go func() {
+			geoDB.watch()
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Errorf("watch with geoWatchInterval %s didn't return", interval)
+		}
+	}
+	viper.Set("geoWatchInterval", nil)
+}
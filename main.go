@@ -3,14 +3,16 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"flag"
 	"fmt"
 	"log"
+	"os"
+	"os/signal"
 	"path"
 	"strings"
-
-	"github.com/oschwald/geoip2-golang"
+	"syscall"
 
 	"github.com/kardianos/osext"
 	_ "github.com/lib/pq"
@@ -23,10 +25,8 @@ var (
 	bdb *bolt.DB
 	db  *sql.DB
 
-	geoCityDB *geoip2.Reader
-	geoASNdb  *geoip2.Reader
-
-	buildStart = flag.Int("startAt", -1, "start index for processing DMARC report emails")
+	offline = flag.Bool("offline", false, "skip network enrichment, marking records pending for `dmarcdb reenrich --pending`")
+	web     = flag.Bool("web", false, "serve the web interface alongside the command, and afterwards until interrupted")
 )
 
 func readConfig() error {
@@ -40,18 +40,15 @@ func readConfig() error {
 
 func dbConnect() error {
 	var err error
-	bdb, err = bolt.Open("dmarc.db", 0666, nil)
-	if err != nil {
-		return err
-	}
-
-	geoCityDB, err = geoip2.Open(viper.GetString("geocitydb"))
-	if err != nil {
+	// don't wait forever on another dmarcdb holding the lock, i.e. one serving the web interface
+	bdb, err = bolt.Open("dmarc.db", 0666, &bolt.Options{Timeout: viper.GetDuration("boltTimeout")})
+	if err == bolt.ErrTimeout {
+		return fmt.Errorf("dmarc.db is locked by another running dmarcdb: %s", err)
+	} else if err != nil {
 		return err
 	}
 
-	geoASNdb, err = geoip2.Open(viper.GetString("geoasndb"))
-	if err != nil {
+	if err = geoDB.open(); err != nil {
 		return err
 	}
 
@@ -65,35 +62,33 @@ func dbConnect() error {
 			return
 		}
 		_, err = tx.CreateBucketIfNotExists([]byte("hosts-cache"))
+		if err != nil {
+			return
+		}
+		_, err = tx.CreateBucketIfNotExists([]byte("dnsbl-cache"))
+		if err != nil {
+			return
+		}
+		_, err = tx.CreateBucketIfNotExists([]byte("checkpoints"))
+		if err != nil {
+			return
+		}
+		_, err = tx.CreateBucketIfNotExists([]byte("rollups"))
 		return
 	})
 	if err != nil {
 		return err
 	}
 
-	var proto = strings.Split(viper.GetString("database"), "://")[0]
-	switch proto {
-	case "postgres":
-		db, err = sql.Open(proto, viper.GetString("database"))
-	default:
-		db, err = sql.Open("sqlserver", viper.GetString("database"))
-	}
-
+	db, err = sql.Open(dialect(), viper.GetString("database"))
 	return err
 }
 
-func init() {
-	if err := readConfig(); err != nil {
-		log.Fatal(err)
-	}
-
-	if err := dbConnect(); err != nil {
-		log.Fatal(err)
-	}
-}
-
 func main() {
 	flag.Parse()
+	if *offline {
+		viper.Set("offline", true)
+	}
 	progPath, err := osext.ExecutableFolder()
 	if err != nil {
 		log.Fatal(err)
@@ -101,59 +96,141 @@ func main() {
 
 	viper.SetDefault("geocitydb", "GeoLite2-City.mmdb")
 	viper.SetDefault("geoasndb", "GeoLite2-ASN.mmdb")
+	viper.SetDefault("geoWatchInterval", "1m")
+	viper.SetDefault("geoUpdateURL", "https://download.maxmind.com/app/geoip_download?edition_id={edition}&license_key={license}&suffix=tar.gz")
+	viper.SetDefault("geoChecksumURL", "https://download.maxmind.com/app/geoip_download?edition_id={edition}&license_key={license}&suffix=tar.gz.sha256")
 	viper.SetDefault("environment", "prod")
 	viper.SetDefault("duplicates", false)
 	viper.SetDefault("stopOnError", false)
+	viper.SetDefault("reportWorkers", 4)
 	viper.SetDefault("cacheHosts", true)
+	viper.SetDefault("dnsbl", []string{})
+	viper.SetDefault("dnsblTTL", "24h")
+	viper.SetDefault("dnsblTimeout", "5s")
+	viper.SetDefault("enrichers", []string{"geoip", "hostname", "sender", "dnsbl", "spf", "alignment"})
+	viper.SetDefault("enricherTimeout", "10s")
+	viper.SetDefault("spfCacheTTL", "1h")
+	viper.SetDefault("offline", false)
 	viper.SetDefault("web", false)
 	viper.SetDefault("port", ":8080")
+	viper.SetDefault("shutdownTimeout", "10s")
+	viper.SetDefault("boltTimeout", "5s")
 	viper.SetDefault("templates", path.Join(progPath, "templates"))
+	viper.SetDefault("senderRules", path.Join(progPath, "senders.json"))
+	viper.SetDefault("archiveDir", path.Join(progPath, "archive"))
+	viper.SetDefault("maxReportSize", "64MB")
+	viper.SetDefault("maxAttachmentSize", "16MB")
+	viper.SetDefault("maxArchiveEntries", 100)
+	viper.SetDefault("maxXMLDepth", 32)
+	viper.SetDefault("maxReportRecords", 100000)
+	viper.SetDefault("adviseThreshold", 0.005)
+	viper.SetDefault("adviseLegitPassRate", 0.5)
+	viper.SetDefault("advisePctSteps", []string{"10", "25", "50", "100"})
+	viper.SetDefault("coverageOverdueFactor", 2.0)
+	viper.SetDefault("coverageGapTolerance", "1h")
+	viper.SetDefault("rollupAfterBuild", true)
+	viper.SetDefault("retainRecords", "395d")
+	viper.SetDefault("retainRollups", "1825d")
+	viper.SetDefault("retainFails", "395d")
+	viper.SetDefault("anomalyBaselineWeeks", 8)
+	viper.SetDefault("anomalyZ", 3.0)
+	viper.SetDefault("anomalyMinMessages", 100)
 
-	if viper.GetBool("web") {
+	// configured here rather than in init, once the defaults are set, so tests don't need Outlook, a config or database
+	if err = openOutlook(); err != nil {
+		log.Fatal(err)
+	}
+	if err = readConfig(); err != nil {
+		log.Fatal(err)
+	}
+	defaultResoler = dnsResolver()
+	spfChecker = newSPFEvaluator(defaultResoler, viper.GetDuration("spfCacheTTL"))
+
+	if err = dbConnect(); err != nil {
+		log.Fatal(err)
+	}
+
+	if senderRules, err = loadSenderRules(); err != nil {
+		log.Fatal(err)
+	}
+
+	// pick up replaced GeoIP databases without restarting
+	go geoDB.watch()
+	reloadOnHangup()
+
+	// the web interface is served by `serve`, with -web, or when building with web set in the config,
+	// rather than keeping every other command from exiting
+	serve := *web || flag.Arg(0) == "serve" || (flag.Arg(0) == "build" && viper.GetBool("web"))
+
+	ctx, stop := shutdownContext()
+	webDone := make(chan struct{})
+	if serve {
 		go func() {
-			if err := startWeb(viper.GetString("port")); err != nil {
-				log.Fatal(err)
+			defer close(webDone)
+			if err := startWeb(ctx, viper.GetString("port")); err != nil {
+				log.Printf("Web server stopped: %s", err)
 			}
 		}()
 	}
 
 	if flag.NArg() >= 1 {
 		switch flag.Arg(0) {
+		// i.e. `dmarcdb serve`, serving the web interface until interrupted
+		case "serve":
 		// i.e. `dmarcdb build`
+		// i.e. `dmarcdb build --since 30d /path/to/folder` for spidering specific Outlook folder
 		case "build":
-			// i.e. `dmarcdb build /path/to/folder` for spidering specific Outlook folder
-			if flag.NArg() >= 2 {
-				viper.Set("mailFolder", flag.Arg(1))
-			}
-			err = build(strings.Split(viper.GetString("mailFolder"), "/")...)
+			err = build(ctx, flag.Args()[1:]...)
+		// i.e. `dmarcdb senders add Mailchimp authorized AS14086`
+		case "senders":
+			err = senders(flag.Args()[1:]...)
+		// i.e. `dmarcdb dns-snapshot` or `dmarcdb dns-snapshot drift`
+		case "dns-snapshot":
+			err = dnsSnapshots(ctx, flag.Args()[1:]...)
+		// i.e. `dmarcdb geo update`
+		case "geo":
+			err = geo(flag.Args()[1:]...)
+		// i.e. `dmarcdb reenrich --since 30d --where "domain = 'wvu.edu'"`
+		case "reenrich":
+			err = reenrich(ctx, flag.Args()[1:]...)
+		// i.e. `dmarcdb reprocess 12345678901234567890`
+		case "reprocess":
+			err = reprocess(ctx, flag.Args()[1:]...)
 		case "config":
 			log.Println("Loaded configuration: ")
 			for k, v := range viper.AllSettings() {
 				fmt.Println(k, ": ", v)
 			}
+		// i.e. `dmarcdb report fails --since 30d --domain wvu.edu --format csv`
+		case "report":
+			err = reports(flag.Args()[1:]...)
+		// i.e. `dmarcdb advise wvu.edu --since 60d`
+		case "advise":
+			err = advise(flag.Args()[1:]...)
+		// i.e. `dmarcdb new-senders --since 7d`
+		case "new-senders":
+			err = newSenders(flag.Args()[1:]...)
+		// i.e. `dmarcdb rollup --full`
+		case "rollup":
+			err = rollupCmd(ctx, flag.Args()[1:]...)
+		// i.e. `dmarcdb prune --dry-run`
+		case "prune":
+			err = prune(ctx, flag.Args()[1:]...)
+		// i.e. `dmarcdb anomalies --days 7 --alert`
+		case "anomalies":
+			err = anomalies(flag.Args()[1:]...)
+		// i.e. `dmarcdb coverage --domain wvu.edu --alert`
+		case "coverage":
+			err = coverage(flag.Args()[1:]...)
+		// i.e. `dmarcdb tree --domain wvu.edu`
+		case "tree":
+			err = tree(flag.Args()[1:]...)
+		// i.e. `dmarcdb logs --since 30d --reporter google.com`
 		case "logs":
-			err = bdb.View(func(tx *bolt.Tx) error {
-				b := tx.Bucket([]byte("processed-fail"))
-				fmt.Println("Fetching logs")
-				if b != nil {
-					m := map[string]int{}
-					err = b.ForEach(func(k, v []byte) error {
-						if val, ok := m[string(v[:])]; !ok {
-							m[string(v[:])] = 1
-						} else {
-							m[string(v[:])] = val + 1
-						}
-						return nil
-					})
-					if err != nil {
-						return err
-					}
-					for txt, num := range m {
-						fmt.Printf("(%d) %s \n", num, txt)
-					}
-				}
-				return nil
-			})
+			err = logs(flag.Args()[1:]...)
+		// i.e. `dmarcdb retry-failed --reporter google.com`
+		case "retry-failed":
+			err = retryFailed(ctx, flag.Args()[1:]...)
 		case "flush":
 			delBucket := func(key string) error {
 				return bdb.Update(func(tx *bolt.Tx) error {
@@ -168,11 +245,15 @@ func main() {
 						err = delBucket("processed-fail")
 					case "hosts":
 						err = delBucket("hosts-cache")
+					case "dnsbl":
+						err = delBucket("dnsbl-cache")
+					case "checkpoints":
+						err = delBucket("checkpoints")
 					}
 				}
 			} else {
-				fmt.Printf("Flushing all fails and hosts")
-				for _, b := range []string{"processed-fail", "hosts-cache"} {
+				fmt.Printf("Flushing all fails, hosts and dnsbl listings")
+				for _, b := range []string{"processed-fail", "hosts-cache", "dnsbl-cache"} {
 					if err = delBucket(b); err != nil {
 						break
 					}
@@ -185,11 +266,56 @@ func main() {
 		fmt.Println("No command line arguments given")
 	}
 
+	// keep serving the web interface until interrupted, unless the command failed
+	if serve {
+		if err != nil {
+			stop()
+		}
+		<-webDone
+	}
+
+	// close bolt cleanly so its lock is released and nothing is left half written
+	if closeErr := bdb.Close(); closeErr != nil && err == nil {
+		err = closeErr
+	}
+	db.Close()
+
 	if err != nil {
 		log.Fatal(err)
 	}
 }
 
+// returns a context canceled on SIGINT or SIGTERM, so work in progress can finish or roll back,
+// exiting immediately on a second signal
+func shutdownContext() (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	sigs := make(chan os.Signal, 2)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-sigs
+		log.Printf("Received %s, shutting down (again to quit immediately)", sig)
+		cancel()
+		<-sigs
+		os.Exit(1)
+	}()
+	return ctx, cancel
+}
+
+// reloads the GeoIP databases on each SIGHUP, as well as when watch sees their files change
+func reloadOnHangup() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			if err := geoDB.open(); err != nil {
+				log.Printf("Failed reloading GeoIP databases: %s", err)
+			} else {
+				log.Printf("Reloaded GeoIP databases on SIGHUP")
+			}
+		}
+	}()
+}
+
 func devLogger(msg string) {
 	if viper.GetString("environment") == "dev" {
 		fmt.Println(msg)
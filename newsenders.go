@@ -0,0 +1,242 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// a source seen sending as one of our domains, keyed in the "sender_first_seen" table by its header_from
+// domain and network, i.e. its ASN or, when that isn't known, its IP
+type sighting struct {
+	domain, network string
+	asn             interface{}
+	sourceIP        string
+	key             string
+	index           int
+}
+
+// the header_from domain a record's mail was sent as, falling back to the policy domain when it wasn't reported
+func fromDomain(report *DMARCFeedback, record DMARCRecord) string {
+	from := record.HeaderFrom
+	if from == "" || from == "NULL" {
+		from = report.Policy.Domain
+	}
+	return strings.ToLower(strings.TrimSuffix(from, "."))
+}
+
+// the same as fromDomain, as an expression on the records table
+func fromDomainCol() string {
+	return fmt.Sprintf("LOWER(CASE WHEN header_from IS NULL OR %[1]s IN ('', 'NULL') THEN %[2]s ELSE %[1]s END)", textCol("header_from"), textCol("domain"))
+}
+
+func sourceNetwork(asn interface{}, sourceIP string) string {
+	if n, ok := asn.(int64); ok && n > 0 {
+		return fmt.Sprintf("AS%d", n)
+	}
+	return sourceIP
+}
+
+func (report *DMARCFeedback) sighting(i int, key string, record DMARCRecord, attrs Attributes) sighting {
+	asn := attrs.intValue("asn")
+	return sighting{fromDomain(report, record), sourceNetwork(asn, record.SourceIP), asn, record.SourceIP, key, i}
+}
+
+// records when each source was first seen sending as each domain, keeping the earliest report's date range
+// if an older report is stored later (i.e. by a backfill or reprocess). Each sighting is a single upsert, so
+// reports stored concurrently can't both insert the same source
+func storeSightings(txn *sql.Tx, firstSeen int64, sightings map[[2]string]sighting) error {
+	var query string
+	switch dialect() {
+	case "postgres":
+		query = `INSERT INTO sender_first_seen (domain, network, asn, source_ip, first_seen, detected_at, record_key) VALUES ($1, $2, $3, $4, $5, $6, $7)
+			ON CONFLICT (domain, network) DO UPDATE SET first_seen = EXCLUDED.first_seen, record_key = EXCLUDED.record_key, source_ip = EXCLUDED.source_ip
+			WHERE sender_first_seen.first_seen > EXCLUDED.first_seen`
+	default:
+		// HOLDLOCK keeps the key range locked between MERGE's match and insert
+		query = `MERGE sender_first_seen WITH (HOLDLOCK) AS f
+			USING (SELECT $1 AS domain, $2 AS network, $3 AS asn, $4 AS source_ip, $5 AS first_seen, $6 AS detected_at, $7 AS record_key) AS s
+			ON f.domain = s.domain AND f.network = s.network
+			WHEN MATCHED AND f.first_seen > s.first_seen THEN UPDATE SET first_seen = s.first_seen, record_key = s.record_key, source_ip = s.source_ip
+			WHEN NOT MATCHED THEN INSERT (domain, network, asn, source_ip, first_seen, detected_at, record_key) VALUES (s.domain, s.network, s.asn, s.source_ip, s.first_seen, s.detected_at, s.record_key);`
+	}
+	stmt, err := txn.Prepare(rebind(query))
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for _, s := range sightings {
+		if _, err = stmt.Exec(s.domain, s.network, s.asn, s.sourceIP, firstSeen, time.Now().Unix(), s.key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// a first appearance of a source sending as one of our domains, with what it's sent since
+type newSender struct {
+	Domain      string    `json:"domain"`
+	Network     string    `json:"network"`
+	SourceIP    string    `json:"source_ip"`
+	FirstSeen   time.Time `json:"first_seen"`
+	DetectedAt  time.Time `json:"detected_at"`
+	Reporter    string    `json:"reporter"`
+	ReportID    string    `json:"report_id"`
+	Hostname    string    `json:"hostname"`
+	Sender      string    `json:"sender"`
+	Location    string    `json:"location"`
+	DKIM        string    `json:"dkim"`
+	SPF         string    `json:"spf"`
+	Disposition string    `json:"disposition"`
+	Messages    int64     `json:"messages"`
+	Passing     int64     `json:"passing"`
+}
+
+// loads the sources first seen sending as our domains since a time, newest first, with their first record
+// and the messages they've sent since
+func loadNewSenders(since time.Time, domain string) ([]newSender, error) {
+	var (
+		conds  = "f.first_seen >= $1"
+		params = []interface{}{since.Unix()}
+		// the records sent as the same domain from the same network
+		match = fmt.Sprintf("%s = f.domain AND ((f.asn IS NOT NULL AND asn = f.asn) OR (f.asn IS NULL AND %s = f.source_ip))", fromDomainCol(), textCol("source_ip"))
+	)
+	if domain != "" {
+		conds += " AND f.domain = $2"
+		params = append(params, strings.ToLower(domain))
+	}
+	query := fmt.Sprintf(`SELECT f.domain, f.network, f.source_ip, f.first_seen, f.detected_at, r.org_name, r.report_id, r.hostname, r.sender, r.location, r.dkim, r.spf, r.disposition,
+		(SELECT SUM(count) FROM records WHERE %[1]s), (SELECT SUM(CASE WHEN %[2]s THEN count ELSE 0 END) FROM records WHERE %[1]s)
+		FROM sender_first_seen f LEFT JOIN records r ON %[4]s = f.record_key WHERE %[3]s ORDER BY f.first_seen DESC`, match, evaluatedPass(), conds, textCol("r.record_key"))
+	rows, err := db.Query(rebind(query), params...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var senders []newSender
+	for rows.Next() {
+		var (
+			s                                                                      newSender
+			firstSeen, detectedAt                                                  int64
+			reporter, reportID, hostname, sender, location, dkim, spf, disposition sql.NullString
+			messages, passing                                                      sql.NullInt64
+		)
+		err = rows.Scan(&s.Domain, &s.Network, &s.SourceIP, &firstSeen, &detectedAt, &reporter, &reportID, &hostname, &sender, &location, &dkim, &spf, &disposition, &messages, &passing)
+		if err != nil {
+			return nil, err
+		}
+		s.FirstSeen, s.DetectedAt = time.Unix(firstSeen, 0).UTC(), time.Unix(detectedAt, 0).UTC()
+		s.Reporter, s.ReportID, s.Hostname, s.Sender, s.Location = reporter.String, reportID.String, hostname.String, sender.String, location.String
+		s.DKIM, s.SPF, s.Disposition = dkim.String, spf.String, disposition.String
+		s.Messages, s.Passing = messages.Int64, passing.Int64
+		senders = append(senders, s)
+	}
+	return senders, rows.Err()
+}
+
+// handles `dmarcdb new-senders [--since 7d] [--domain wvu.edu] [--json] [--backfill]`, listing sources
+// seen sending as our domains for the first time
+func newSenders(args ...string) error {
+	var (
+		flags    = flag.NewFlagSet("new-senders", flag.ContinueOnError)
+		since    = flags.String("since", "7d", "only sources first seen since, i.e. 7d or 2018-01-31")
+		domain   = flags.String("domain", "", "only sources sending as this domain")
+		asJSON   = flags.Bool("json", false, "print each new sender as JSON")
+		backfill = flags.Bool("backfill", false, "first fill in the first sightings of the records stored before they were tracked")
+	)
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	sinceTime, err := parseSince(*since)
+	if err != nil {
+		return err
+	}
+
+	if *backfill {
+		if err = backfillSightings(); err != nil {
+			return err
+		}
+	}
+
+	senders, err := loadNewSenders(sinceTime, *domain)
+	if err != nil {
+		return err
+	}
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(senders)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "FIRST SEEN\tDOMAIN\tNETWORK\tSOURCE IP\tHOSTNAME\tSENDER\tLOCATION\tDKIM\tSPF\tDISPOSITION\tMESSAGES\tPASSING\tREPORTER")
+	for _, s := range senders {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%d\t%d\t%s\n", s.FirstSeen.Format("2006-01-02"), s.Domain, s.Network, s.SourceIP, s.Hostname, s.Sender, s.Location, s.DKIM, s.SPF, s.Disposition, s.Messages, s.Passing, s.Reporter)
+	}
+	return w.Flush()
+}
+
+// fills "sender_first_seen" from the records already stored, i.e. after upgrading, so they aren't all
+// reported as new by the next build; each sighting keeps the record of its earliest report
+func backfillSightings() error {
+	// the earliest record of each domain, ASN and IP, by its report's date range
+	query := fmt.Sprintf(`SELECT domain, asn, source_ip, date_range_begin, record_key FROM (
+		SELECT %[1]s AS domain, asn, %[2]s AS source_ip, date_range_begin, %[3]s AS record_key,
+			ROW_NUMBER() OVER (PARTITION BY %[1]s, asn, %[2]s ORDER BY date_range_begin, id) AS n FROM records) r WHERE n = 1`,
+		fromDomainCol(), textCol("source_ip"), textCol("record_key"))
+	rows, err := db.Query(query)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	var (
+		sightings = map[[2]string]sighting{}
+		earliest  = map[[2]string]int64{}
+	)
+	for rows.Next() {
+		var (
+			domain, sourceIP, key sql.NullString
+			asn                   sql.NullInt64
+			begin                 int64
+		)
+		if err = rows.Scan(&domain, &asn, &sourceIP, &begin, &key); err != nil {
+			return err
+		}
+		s := sighting{domain: domain.String, sourceIP: sourceIP.String, key: key.String}
+		if asn.Valid {
+			s.asn = asn.Int64
+		}
+		s.network = sourceNetwork(s.asn, s.sourceIP)
+		id := [2]string{s.domain, s.network}
+		if first, ok := earliest[id]; !ok || begin < first {
+			sightings[id], earliest[id] = s, begin
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	txn, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	for id, s := range sightings {
+		if err = storeSightings(txn, earliest[id], map[[2]string]sighting{id: s}); err != nil {
+			txn.Rollback()
+			return err
+		}
+	}
+	if err = txn.Commit(); err != nil {
+		return err
+	}
+	fmt.Printf("Backfilled the first sightings of %d sources\n", len(sightings))
+	return nil
+}
@@ -1,18 +1,14 @@
 package main
 
 import (
-	"compress/gzip"
 	"fmt"
-	"io"
 	"io/ioutil"
-	"log"
 	"os"
 	"path/filepath"
-	"strings"
 
 	"github.com/go-ole/go-ole"
 	"github.com/go-ole/go-ole/oleutil"
-	"github.com/mholt/archiver"
+	"github.com/spf13/viper"
 )
 
 var (
@@ -20,13 +16,15 @@ var (
 	outlook *ole.IDispatch
 )
 
-func init() {
+// connects to Outlook, called from main rather than init so tests can run without it
+func openOutlook() error {
 	ole.CoInitializeEx(0, ole.COINIT_MULTITHREADED)
 	app, err := oleutil.CreateObject("Outlook.Application")
-	outlook, err = app.QueryInterface(ole.IID_IDispatch)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
+	outlook, err = app.QueryInterface(ole.IID_IDispatch)
+	return err
 }
 
 func getFolder(namespace *ole.IDispatch, path ...string) *ole.IDispatch {
@@ -40,85 +38,38 @@ func getFolder(namespace *ole.IDispatch, path ...string) *ole.IDispatch {
 	return folder
 }
 
-func openAttachment(attachment *ole.IDispatch) (io.Reader, error) {
-	var (
-		// create a temporary directory to save attachment(s) to
-		dir, err = ioutil.TempDir("", "dmarc")
-		filename = oleutil.MustGetProperty(attachment, "FileName").Value().(string)
-		saveTo   = filepath.Join(dir, filename)
-		arx      = archiver.MatchingFormat(filename)
-		r        io.Reader
-	)
+// saves an attachment, archives the original and returns the reports it contains
+func openAttachment(attachment *ole.IDispatch) ([]*rawReport, error) {
+	// create a temporary directory to save attachment(s) to
+	dir, err := ioutil.TempDir("", "dmarc")
 	if err != nil {
 		return nil, err
 	}
+	// the attachment is read into memory, so nothing is left behind once it's saved
+	defer os.RemoveAll(dir)
 
+	filename := oleutil.MustGetProperty(attachment, "FileName").Value().(string)
 	fmt.Printf("Opening %s\n", filename)
+	// don't even save what's too large to be a report
+	if size, max := oleutil.MustGetProperty(attachment, "Size").Value().(int32), viper.GetSizeInBytes("maxAttachmentSize"); uint(size) > max {
+		return []*rawReport{{Filename: filename, Err: limitError(fmt.Sprintf("%s is larger than maxAttachmentSize (%d bytes)", filename, max))}}, nil
+	}
 	// save mail attachment to temporary directory
+	saveTo := filepath.Join(dir, filename)
 	oleutil.MustCallMethod(attachment, "SaveAsFile", saveTo)
 
-	// get name of the XML file to open
-	var (
-		isXML   = func(n string) bool { return strings.HasSuffix(n, ".xml") }
-		xmlFile = filepath.Join(dir, trimFrom(filename, ".xml"))
-	)
-	if strings.Contains(filename, ".xml") {
-		xmlFile += ".xml"
-	} else if strings.HasSuffix(filename, ".zip") {
-		xmlFile = strings.Replace(xmlFile, ".zip", ".xml", 1)
+	b, err := ioutil.ReadFile(saveTo)
+	if err != nil {
+		return nil, err
 	}
-
-	// unarchive the attachment in the respective way (if required)
-	if strings.HasSuffix(filename, ".xml.gz") || strings.HasSuffix(filename, ".gzip") {
-		// file is simple XML gzip'd
-		att, err := os.Open(saveTo)
-		if err != nil {
-			return nil, err
-		}
-
-		return gzip.NewReader(att)
-	} else if arx != nil {
-		// file is a supported type by archiver tool
-		err = arx.Open(saveTo, dir)
-		if err != nil {
-			return nil, err
-		}
-
-		r, err = os.Open(xmlFile)
-		// if the file in the archive is named differently than expected
-		if os.IsNotExist(err) {
-			xmlFile = ""
-			devLogger("XML file not defaultly named, searching " + dir)
-			// walk through the directory which we unarchived it to
-			err = filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
-				if err != nil {
-					return err
-				}
-
-				if xmlFile != "" {
-					return filepath.SkipDir
-				}
-
-				// and find the XML file and set its path to xmlFile
-				if isXML(path) || isXML(info.Name()) {
-					xmlFile = path
-				}
-				return nil
-			})
-			if err != nil {
-				return nil, err
-			}
-
-			// so we can open it properly
-			return os.Open(xmlFile)
-		}
-	} else if !isXML(filename) {
-		// file type not gzip or recognized by archiver tool
-		return nil, fmt.Errorf("File type \"%s\" not yet supported", filename)
-	} else {
-		r, err = os.Open(xmlFile)
+	hash, err := archiveReport(b, filename)
+	if err != nil {
+		return nil, err
 	}
-
-	// file is a regular XML file
-	return r, err
+	reports, err := rawReports(hash, filename, b)
+	if err != nil {
+		// the original is archived, so it can be reprocessed once the cause is fixed
+		return []*rawReport{{Hash: hash, Filename: filename, Err: err}}, nil
+	}
+	return reports, nil
 }
@@ -0,0 +1,401 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/spf13/viper"
+)
+
+// the monthly partitions of a partitioned records table, i.e. records_2018_01 (see sql/psql/partition_records.sql)
+var partitionName = regexp.MustCompile(`^records_(\d{4})_(\d{2})$`)
+
+// returns when a retention setting (i.e. 395d) starts, or the zero time when it's empty and kept forever
+func retentionCutoff(key string) (time.Time, error) {
+	cutoff, err := parseSince(viper.GetString(key))
+	if err != nil {
+		return cutoff, fmt.Errorf("%s: %s", key, err)
+	}
+	return cutoff, nil
+}
+
+// handles `dmarcdb prune [--dry-run] [--batch 5000]`, deleting what's older than the retention settings
+func prune(ctx context.Context, args ...string) error {
+	var (
+		flags  = flag.NewFlagSet("prune", flag.ContinueOnError)
+		dryRun = flags.Bool("dry-run", false, "only count what would be deleted")
+		batch  = flags.Int("batch", 5000, "records deleted per transaction, so tables aren't locked for long")
+	)
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	records, err := retentionCutoff("retainRecords")
+	if err != nil {
+		return err
+	}
+	rollups, err := retentionCutoff("retainRollups")
+	if err != nil {
+		return err
+	}
+	fails, err := retentionCutoff("retainFails")
+	if err != nil {
+		return err
+	}
+
+	if !records.IsZero() {
+		if err = pruneRecords(ctx, records, *batch, *dryRun); err != nil {
+			return err
+		}
+		if err = pruneArchive(ctx, records, *dryRun); err != nil {
+			return err
+		}
+	}
+	if !rollups.IsZero() {
+		if err = pruneRollups(ctx, rollups, *dryRun); err != nil {
+			return err
+		}
+	}
+	return pruneBolt(fails, *dryRun)
+}
+
+// deletes the records (and their attributes) of reports which began before the cutoff, dropping whole monthly
+// partitions when records is partitioned, then deleting what's left in batches
+func pruneRecords(ctx context.Context, cutoff time.Time, batch int, dryRun bool) error {
+	partitioned, partitions, err := recordPartitions()
+	if err != nil {
+		return err
+	}
+	for name, end := range partitions {
+		if end.After(cutoff) {
+			continue
+		}
+		if dryRun {
+			fmt.Printf("Would drop partition %s\n", name)
+			continue
+		}
+		if err = dropPartition(ctx, name); err != nil {
+			return err
+		}
+		fmt.Printf("Dropped partition %s\n", name)
+	}
+	if !dryRun && partitioned {
+		if err = ensurePartitions(ctx); err != nil {
+			return err
+		}
+	}
+
+	if dryRun {
+		var n int64
+		if err = db.QueryRowContext(ctx, rebind("SELECT COUNT(*) FROM records WHERE date_range_begin < $1"), cutoff.Unix()).Scan(&n); err != nil {
+			return err
+		}
+		fmt.Printf("Would delete %d records of reports which began before %s\n", n, cutoff.Format("2006-01-02"))
+		return nil
+	}
+
+	var deleted int
+	for ctx.Err() == nil {
+		ids, err := expiredRecords(ctx, cutoff, batch)
+		if err != nil {
+			return err
+		}
+		if len(ids) == 0 {
+			break
+		}
+		if err = deleteRecords(ctx, ids); err != nil {
+			return err
+		}
+		deleted += len(ids)
+	}
+	fmt.Printf("Deleted %d records of reports which began before %s\n", deleted, cutoff.Format("2006-01-02"))
+	return ctx.Err()
+}
+
+func expiredRecords(ctx context.Context, cutoff time.Time, batch int) ([]string, error) {
+	rows, err := db.QueryContext(ctx, rebind(limit("SELECT id FROM records WHERE date_range_begin < $1", batch)), cutoff.Unix())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []string
+	for rows.Next() {
+		var id int64
+		if err = rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, strconv.FormatInt(id, 10))
+	}
+	return ids, rows.Err()
+}
+
+// drops a monthly partition of records along with its records' attributes, in one transaction so
+// neither goes without the other
+func dropPartition(ctx context.Context, name string) error {
+	txn, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	if _, err = txn.Exec(fmt.Sprintf("DELETE FROM record_attributes WHERE record_key IN (SELECT record_key FROM %s)", name)); err != nil {
+		txn.Rollback()
+		return err
+	}
+	if _, err = txn.Exec("DROP TABLE " + name); err != nil {
+		txn.Rollback()
+		return err
+	}
+	return txn.Commit()
+}
+
+// deletes a batch of records by id, along with their attributes, in one short transaction
+func deleteRecords(ctx context.Context, ids []string) error {
+	in := strings.Join(ids, ", ")
+	txn, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	if _, err = txn.Exec(fmt.Sprintf("DELETE FROM record_attributes WHERE record_key IN (SELECT record_key FROM records WHERE id IN (%s))", in)); err != nil {
+		txn.Rollback()
+		return err
+	}
+	if _, err = txn.Exec(fmt.Sprintf("DELETE FROM records WHERE id IN (%s)", in)); err != nil {
+		txn.Rollback()
+		return err
+	}
+	return txn.Commit()
+}
+
+// returns whether records is a partitioned PostgreSQL table, and its monthly partitions and when each ends
+func recordPartitions() (bool, map[string]time.Time, error) {
+	var (
+		partitioned bool
+		partitions  = map[string]time.Time{}
+	)
+	if dialect() != "postgres" {
+		return false, partitions, nil
+	}
+	if err := db.QueryRow("SELECT EXISTS (SELECT 1 FROM pg_partitioned_table WHERE partrelid = 'records'::regclass)").Scan(&partitioned); err != nil || !partitioned {
+		return false, partitions, err
+	}
+	rows, err := db.Query("SELECT c.relname FROM pg_inherits i JOIN pg_class c ON c.oid = i.inhrelid WHERE i.inhparent = 'records'::regclass")
+	if err != nil {
+		return false, nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var name string
+		if err = rows.Scan(&name); err != nil {
+			return false, nil, err
+		}
+		// the default partition, of reports outside every monthly one, is only ever pruned by deleting from it
+		m := partitionName.FindStringSubmatch(name)
+		if m == nil {
+			continue
+		}
+		year, _ := strconv.Atoi(m[1])
+		month, _ := strconv.Atoi(m[2])
+		partitions[name] = time.Date(year, time.Month(month)+1, 1, 0, 0, 0, 0, time.UTC)
+	}
+	return true, partitions, rows.Err()
+}
+
+// creates the partitions of this month, next month and the one after, so reports always have one to go in
+// rather than the default partition
+func ensurePartitions(ctx context.Context) error {
+	month := time.Now().UTC()
+	month = time.Date(month.Year(), month.Month(), 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i <= 2; i++ {
+		begin, end := month.AddDate(0, i, 0), month.AddDate(0, i+1, 0)
+		name := "records_" + begin.Format("2006_01")
+		var exists bool
+		if err := db.QueryRowContext(ctx, "SELECT to_regclass($1) IS NOT NULL", name).Scan(&exists); err != nil {
+			return err
+		} else if exists {
+			continue
+		}
+		if err := createPartition(ctx, name, begin, end); err != nil {
+			return fmt.Errorf("creating partition %s: %s", name, err)
+		}
+	}
+	return nil
+}
+
+// creates a monthly partition of records. Postgres won't create one while the default partition holds records
+// in its range (i.e. reports stored before it existed), so the default is detached while they're moved into it
+func createPartition(ctx context.Context, name string, begin, end time.Time) error {
+	txn, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer txn.Rollback()
+
+	create := fmt.Sprintf("CREATE TABLE %s PARTITION OF records FOR VALUES FROM (%d) TO (%d)", name, begin.Unix(), end.Unix())
+	var def string
+	err = txn.QueryRow("SELECT c.relname FROM pg_inherits i JOIN pg_class c ON c.oid = i.inhrelid WHERE i.inhparent = 'records'::regclass AND pg_get_expr(c.relpartbound, c.oid) = 'DEFAULT'").Scan(&def)
+	if err == sql.ErrNoRows {
+		if _, err = txn.Exec(create); err != nil {
+			return err
+		}
+		return txn.Commit()
+	} else if err != nil {
+		return err
+	}
+
+	var stray bool
+	inRange := fmt.Sprintf("FROM %s WHERE date_range_begin >= %d AND date_range_begin < %d", def, begin.Unix(), end.Unix())
+	if err = txn.QueryRow("SELECT EXISTS (SELECT 1 " + inRange + ")").Scan(&stray); err != nil {
+		return err
+	}
+	if !stray {
+		if _, err = txn.Exec(create); err != nil {
+			return err
+		}
+		return txn.Commit()
+	}
+
+	for _, stmt := range []string{
+		"ALTER TABLE records DETACH PARTITION " + def,
+		create,
+		fmt.Sprintf("INSERT INTO %s SELECT * %s", name, inRange),
+		"DELETE " + inRange,
+		fmt.Sprintf("ALTER TABLE records ATTACH PARTITION %s DEFAULT", def),
+	} {
+		if _, err = txn.Exec(stmt); err != nil {
+			return err
+		}
+	}
+	return txn.Commit()
+}
+
+// deletes the archived originals of reports without records from after the cutoff, and archived before it
+func pruneArchive(ctx context.Context, cutoff time.Time, dryRun bool) error {
+	query := fmt.Sprintf("SELECT sha256 FROM raw_reports WHERE archived_at < $1 AND NOT EXISTS (SELECT 1 FROM records WHERE %s = sha256 AND date_range_begin >= $1)", textCol("raw_report"))
+	rows, err := db.QueryContext(ctx, rebind(query), cutoff.Unix())
+	if err != nil {
+		return err
+	}
+	var hashes []string
+	for rows.Next() {
+		var hash string
+		if err = rows.Scan(&hash); err != nil {
+			rows.Close()
+			return err
+		}
+		hashes = append(hashes, hash)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	if dryRun {
+		fmt.Printf("Would delete %d archived reports\n", len(hashes))
+		return nil
+	}
+	for _, hash := range hashes {
+		if err = os.Remove(archivePath(hash)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if _, err = db.ExecContext(ctx, rebind("DELETE FROM raw_reports WHERE sha256 = $1"), hash); err != nil {
+			return err
+		}
+	}
+	fmt.Printf("Deleted %d archived reports\n", len(hashes))
+	return nil
+}
+
+// deletes the daily rollup before the cutoff, a month at a time
+func pruneRollups(ctx context.Context, cutoff time.Time, dryRun bool) error {
+	cutoff = cutoff.UTC().Truncate(day)
+	if dryRun {
+		var n int64
+		if err := db.QueryRowContext(ctx, rebind("SELECT COUNT(*) FROM daily_rollup WHERE day < $1"), cutoff.Unix()).Scan(&n); err != nil {
+			return err
+		}
+		fmt.Printf("Would delete %d rollup rows before %s\n", n, cutoff.Format("2006-01-02"))
+		return nil
+	}
+
+	var first *int64
+	if err := db.QueryRowContext(ctx, "SELECT MIN(day) FROM daily_rollup").Scan(&first); err != nil || first == nil {
+		return err
+	}
+	var deleted int64
+	for from := time.Unix(*first, 0).UTC(); from.Before(cutoff) && ctx.Err() == nil; from = from.AddDate(0, 1, 0) {
+		to := from.AddDate(0, 1, 0)
+		if to.After(cutoff) {
+			to = cutoff
+		}
+		result, err := db.ExecContext(ctx, rebind("DELETE FROM daily_rollup WHERE day >= $1 AND day < $2"), from.Unix(), to.Unix())
+		if err != nil {
+			return err
+		}
+		n, _ := result.RowsAffected()
+		deleted += n
+	}
+	fmt.Printf("Deleted %d rollup rows before %s\n", deleted, cutoff.Format("2006-01-02"))
+	return ctx.Err()
+}
+
+// deletes fail log entries last failed before the cutoff and expired blocklist listings. Processed mail is kept
+// whatever its age, since it's what stops mail still in the folder being built again
+func pruneBolt(fails time.Time, dryRun bool) error {
+	var staleFails, expired [][]byte
+	err := bdb.View(func(tx *bolt.Tx) error {
+		if !fails.IsZero() {
+			err := tx.Bucket([]byte("processed-fail")).ForEach(func(k, v []byte) error {
+				if f, _ := parseFailure(k, v); f.LastFailed.Before(fails) {
+					staleFails = append(staleFails, append([]byte(nil), k...))
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+		now := time.Now().Unix()
+		return tx.Bucket([]byte("dnsbl-cache")).ForEach(func(k, v []byte) error {
+			var entry dnsblEntry
+			if json.Unmarshal(v, &entry) != nil || entry.Expires <= now {
+				expired = append(expired, append([]byte(nil), k...))
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	if dryRun {
+		fmt.Printf("Would delete %d fail log entries and %d expired blocklist listings\n", len(staleFails), len(expired))
+		return nil
+	}
+	err = bdb.Update(func(tx *bolt.Tx) error {
+		for _, k := range staleFails {
+			if err := tx.Bucket([]byte("processed-fail")).Delete(k); err != nil {
+				return err
+			}
+		}
+		for _, k := range expired {
+			if err := tx.Bucket([]byte("dnsbl-cache")).Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err == nil {
+		fmt.Printf("Deleted %d fail log entries and %d expired blocklist listings\n", len(staleFails), len(expired))
+	}
+	return err
+}
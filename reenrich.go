@@ -0,0 +1,379 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"flag"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// the records columns which are filled from enricher attributes, and the attribute each comes from
+var enrichedColumns = []struct {
+	column, attr string
+	numeric      bool
+}{
+	{"location", "location", false},
+	{"contact_info", "asn_org", false},
+	{"hostname", "hostname", false},
+	{"asn", "asn", true},
+	{"sender", "sender", false},
+	{"dnsbl", "dnsbl", false},
+	{"spf_eval", "spf_eval", false},
+	{"spf_mechanism", "spf_mechanism", false},
+	{"spf_lookups", "spf_lookups", true},
+	{"geo_build", "geo_build", true},
+	{"dkim_alignment", "dkim_alignment", false},
+	{"spf_alignment", "spf_alignment", false},
+	{"org_domain", "org_domain", false},
+}
+
+// the report columns needed to rebuild a report and record for the enrichers
+var reportColumns = []string{"org_name", "email", "date_range_begin", "date_range_end", "domain", "adkim", "aspf", "p", "pct", "source_ip", "count", "disposition", "dkim", "spf", "reason_type", "comment", "envelope_to", "header_from", "dkim_domain", "dkim_result", "dkim_hresult", "spf_domain", "spf_result"}
+
+// a row of the records table, rebuilt as the report and record it was stored from
+type storedRecord struct {
+	ID      int64
+	Key     string
+	Report  DMARCFeedback
+	Record  DMARCRecord
+	Current map[string]string
+	Pending bool
+	ASNOrg  string
+	Attrs   Attributes
+	Results []enrichment
+}
+
+// handles `dmarcdb reenrich [--pending] [--since 30d] [--where "domain = 'wvu.edu'"] [--batch 500]`
+func reenrich(ctx context.Context, args ...string) error {
+	var (
+		flags   = flag.NewFlagSet("reenrich", flag.ContinueOnError)
+		since   = flags.String("since", "", "only re-enrich records reported since, i.e. 30d or 2018-01-31")
+		where   = flags.String("where", "", "only re-enrich records matching this SQL condition")
+		batch   = flags.Int("batch", 500, "number of records to update per transaction")
+		pending = flags.Bool("pending", false, "only re-enrich records stored while offline")
+	)
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	// re-enriching is the network pass, whatever ingestion is configured as, and looks hostnames up again
+	// rather than trusting what was cached when the records were stored
+	viper.Set("offline", false)
+	viper.Set("refreshHosts", true)
+
+	sinceTime, err := parseSince(*since)
+	if err != nil {
+		return err
+	}
+
+	var (
+		conds   = []string{"id > $1"}
+		params  = []interface{}{int64(0)}
+		lastID  int64
+		rows    int
+		updated int
+		changed = map[string]int{}
+	)
+	if *since != "" {
+		conds = append(conds, "date_range_begin >= $"+strconv.Itoa(len(params)+1))
+		params = append(params, sinceTime.Unix())
+	}
+	if *pending {
+		conds = append(conds, "enrich_pending = $"+strconv.Itoa(len(params)+1))
+		params = append(params, true)
+	}
+	if *where != "" {
+		conds = append(conds, "("+*where+")")
+	}
+
+	for ctx.Err() == nil {
+		params[0] = lastID
+		recs, err := loadRecords(strings.Join(conds, " AND "), *batch, params...)
+		if err != nil {
+			return err
+		}
+		if len(recs) == 0 {
+			break
+		}
+		lastID = recs[len(recs)-1].ID
+
+		enrichAll(ctx, recs)
+		// a batch enriched while being interrupted is left for next time, not stored half-enriched
+		if ctx.Err() != nil {
+			break
+		}
+		n, err := updateRecords(ctx, recs, changed)
+		if err != nil {
+			return err
+		}
+		rows += len(recs)
+		updated += n
+		fmt.Printf("Re-enriched %d records, %d updated\n", rows, updated)
+	}
+
+	var summary []string
+	for col, n := range changed {
+		summary = append(summary, fmt.Sprintf("%s: %d", col, n))
+	}
+	sort.Strings(summary)
+	fmt.Printf("Updated %d of %d records (%s)\n", updated, rows, strings.Join(summary, ", "))
+	return ctx.Err()
+}
+
+// loads up to n records matching cond, ordered by id, along with their stored attributes
+func loadRecords(cond string, n int, params ...interface{}) ([]*storedRecord, error) {
+	selectCols := append([]string{"id", "record_key", "enrich_pending"}, reportColumns...)
+	for _, col := range enrichedColumns {
+		selectCols = append(selectCols, col.column)
+	}
+
+	query := limit(fmt.Sprintf("SELECT %s FROM records WHERE %s ORDER BY id", strings.Join(selectCols, ", "), cond), n)
+	rows, err := db.Query(rebind(query), params...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var recs []*storedRecord
+	for rows.Next() {
+		vals := make([]sql.NullString, len(selectCols))
+		ptrs := make([]interface{}, len(vals))
+		for i := range vals {
+			ptrs[i] = &vals[i]
+		}
+		if err = rows.Scan(ptrs...); err != nil {
+			return nil, err
+		}
+
+		col := map[string]string{}
+		for i, name := range selectCols {
+			col[name] = vals[i].String
+		}
+
+		rec := &storedRecord{Key: col["record_key"], Current: map[string]string{}}
+		rec.ID, _ = strconv.ParseInt(col["id"], 10, 64)
+		rec.Pending, _ = strconv.ParseBool(col["enrich_pending"])
+		rec.Report.Metadata = DMARCMetadata{OrgName: col["org_name"], Email: col["email"]}
+		rec.Report.Metadata.DateRangeBegin, _ = strconv.ParseInt(col["date_range_begin"], 10, 64)
+		rec.Report.Metadata.DateRangeEnd, _ = strconv.ParseInt(col["date_range_end"], 10, 64)
+		rec.Report.Policy = DMARCPolicy{Domain: col["domain"], ADKIM: col["adkim"], ASPF: col["aspf"], P: col["p"]}
+		if pct, err := strconv.Atoi(col["pct"]); err == nil {
+			rec.Report.Policy.PCT = pct
+		} else {
+			rec.Report.Policy.PCT = 100
+		}
+		rec.Record = DMARCRecord{
+			SourceIP:      col["source_ip"],
+			Disposition:   col["disposition"],
+			DKIM:          col["dkim"],
+			SPF:           col["spf"],
+			ReasonType:    col["reason_type"],
+			ReasonComment: col["comment"],
+			EnvelopeTo:    col["envelope_to"],
+			HeaderFrom:    col["header_from"],
+			DKIMDomain:    col["dkim_domain"],
+			DKIMResult:    col["dkim_result"],
+			DKIMHResult:   col["dkim_hresult"],
+			SPFDomain:     col["spf_domain"],
+			SPFResult:     col["spf_result"],
+		}
+		rec.Record.Count, _ = strconv.Atoi(col["count"])
+		for _, c := range enrichedColumns {
+			rec.Current[c.column] = col[c.column]
+		}
+		// without stored attributes, assume the contact info is all AS organization
+		rec.ASNOrg = rec.Current["contact_info"]
+		recs = append(recs, rec)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return recs, loadASNOrgs(recs)
+}
+
+// loads the AS organization each record was stored with, so it can be told apart from extra contact info
+func loadASNOrgs(recs []*storedRecord) error {
+	var (
+		byKey  = map[string]*storedRecord{}
+		params []interface{}
+		marks  []string
+	)
+	for _, rec := range recs {
+		if rec.Key != "" {
+			byKey[rec.Key] = rec
+			params = append(params, rec.Key)
+			marks = append(marks, fmt.Sprintf("$%d", len(params)))
+		}
+	}
+	if len(params) == 0 {
+		return nil
+	}
+
+	rows, err := db.Query(rebind(fmt.Sprintf("SELECT record_key, value FROM record_attributes WHERE enricher = 'geoip' AND name = 'asn_org' AND record_key IN (%s)", strings.Join(marks, ", "))), params...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var key, org sql.NullString
+		if err = rows.Scan(&key, &org); err != nil {
+			return err
+		}
+		if rec, ok := byKey[key.String]; ok {
+			rec.ASNOrg = org.String
+		}
+	}
+	return rows.Err()
+}
+
+// runs the enrichers over each record in parallel
+func enrichAll(ctx context.Context, recs []*storedRecord) {
+	var (
+		wg      sync.WaitGroup
+		workers = make(chan bool, MaxWorkers)
+	)
+	for _, rec := range recs {
+		wg.Add(1)
+		workers <- true
+		go func(rec *storedRecord) {
+			defer wg.Done()
+			defer func() { <-workers }()
+			rec.Attrs, rec.Results = enrich(ctx, &rec.Report, rec.Record)
+		}(rec)
+	}
+	wg.Wait()
+}
+
+// writes the re-enriched values of changed records and replaces their attributes in one transaction,
+// counting the changed values per column
+func updateRecords(ctx context.Context, recs []*storedRecord, changed map[string]int) (int, error) {
+	txn, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer txn.Rollback()
+
+	var (
+		sets    = make([]string, len(enrichedColumns))
+		updated = 0
+		rolled  = map[string]bool{}
+		// the earliest report whose rolled up columns changed, so the daily rollup re-rolls it
+		reroll time.Time
+	)
+	for _, col := range rollupCols {
+		rolled[col] = true
+	}
+	for i, col := range enrichedColumns {
+		sets[i] = fmt.Sprintf("%s = $%d", col.column, i+1)
+	}
+	sets = append(sets, fmt.Sprintf("enrich_pending = $%d", len(sets)+1))
+	update, err := txn.Prepare(rebind(fmt.Sprintf("UPDATE records SET %s WHERE id = $%d", strings.Join(sets, ", "), len(sets)+1)))
+	if err != nil {
+		return 0, err
+	}
+	defer update.Close()
+
+	for _, rec := range recs {
+		var (
+			vals     = make([]interface{}, 0, len(enrichedColumns)+2)
+			produced = Attributes{}
+			pending  = false
+		)
+		// only the attributes of enrichers which succeeded replace what's stored, so a failed or skipped
+		// enricher doesn't blank its columns
+		for _, result := range rec.Results {
+			if result.Err != nil {
+				pending = pending || enrichers[result.Enricher].Network()
+				continue
+			}
+			for k, v := range result.Attrs {
+				produced[k] = v
+			}
+		}
+		// a record stays pending until every network enricher has run on it successfully
+		pending = pending && rec.Pending
+		dirty := rec.Pending != pending
+
+		for _, col := range enrichedColumns {
+			val, ok := produced[col.attr]
+			if !ok {
+				val = rec.Current[col.column]
+			} else if col.column == "contact_info" {
+				// keep any extra contact info the reporter gave after the AS organization
+				val += strings.TrimPrefix(rec.Current[col.column], rec.ASNOrg)
+			}
+			if val != rec.Current[col.column] {
+				changed[col.column]++
+				dirty = true
+				if begin := time.Unix(rec.Report.Metadata.DateRangeBegin, 0); rolled[col.column] && (reroll.IsZero() || begin.Before(reroll)) {
+					reroll = begin
+				}
+			}
+			if !col.numeric {
+				vals = append(vals, val)
+			} else if ok {
+				vals = append(vals, produced.intValue(col.attr))
+			} else {
+				vals = append(vals, Attributes{col.attr: val}.intValue(col.attr))
+			}
+		}
+		if !dirty {
+			continue
+		}
+
+		if _, err = update.Exec(append(vals, pending, rec.ID)...); err != nil {
+			return 0, fmt.Errorf("updating record %d: %s", rec.ID, err)
+		}
+		if err = replaceAttributes(txn, rec); err != nil {
+			return 0, err
+		}
+		updated++
+	}
+
+	if err = txn.Commit(); err != nil || reroll.IsZero() {
+		return updated, err
+	}
+	return updated, rerollFrom(reroll)
+}
+
+// replaces the stored output of each enricher which succeeded with its re-enriched output. Enrichers which failed
+// keep what they stored before, alongside their latest error
+func replaceAttributes(txn *sql.Tx, rec *storedRecord) error {
+	if rec.Key == "" {
+		return nil
+	}
+
+	var (
+		insert      = rebind("INSERT INTO record_attributes (record_key, enricher, name, value) VALUES ($1, $2, $3, $4)")
+		remove      = rebind("DELETE FROM record_attributes WHERE record_key = $1 AND enricher = $2")
+		removeError = rebind("DELETE FROM record_attributes WHERE record_key = $1 AND enricher = $2 AND name = 'error'")
+	)
+	for _, result := range rec.Results {
+		if result.Err != nil {
+			if _, err := txn.Exec(removeError, rec.Key, result.Enricher); err != nil {
+				return err
+			}
+			if _, err := txn.Exec(insert, rec.Key, result.Enricher, "error", result.Err.Error()); err != nil {
+				return err
+			}
+			continue
+		}
+		if _, err := txn.Exec(remove, rec.Key, result.Enricher); err != nil {
+			return err
+		}
+		for name, value := range result.Attrs {
+			if _, err := txn.Exec(insert, rec.Key, result.Enricher, name, value); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
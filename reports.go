@@ -0,0 +1,225 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// reportQuery builds a report's query for the configured database from the WHERE conditions of its filters
+type reportQuery func(where string) string
+
+// the reports read from the daily rollup rather than the records, filtered by day rather than date_range_begin
+var rollupReports = map[string]bool{"top-senders": true}
+
+// the reports of `dmarcdb report`, which mean the same on PostgreSQL and MSSQL
+var reportQueries = map[string]reportQuery{
+	// sources failing both SPF and DKIM, by volume
+	"fails": func(where string) string {
+		cols := []string{"org_name", "source_ip", "hostname", "sender", "domain", "location", "spf_domain", "dnsbl"}
+		return fmt.Sprintf("SELECT %s, SUM(count) AS messages, MAX(date_range_end) AS last_observed FROM records WHERE %s AND %s <> 'pass' AND %s = 'fail' GROUP BY %s ORDER BY messages DESC", selectGrouped(cols...), where, textCol("spf_result"), textCol("dkim"), groupBy(cols...))
+	},
+	// sources sending the most mail as our domains, and how much of it passes DMARC
+	"top-senders": func(where string) string {
+		cols := []string{"sender", "source_ip", "hostname", "location"}
+		return fmt.Sprintf("SELECT %s, SUM(messages) AS messages, SUM(CASE WHEN %s THEN messages ELSE 0 END) AS passing, MAX(day) AS last_observed FROM daily_rollup WHERE %s GROUP BY %s ORDER BY messages DESC", selectGrouped(cols...), evaluatedPass(), where, groupBy(cols...))
+	},
+	// sources which pass DMARC only thanks to relaxed alignment, and would break if adkim or aspf were strict
+	"alignment": func(where string) string {
+		cols := []string{"domain", "sender", "source_ip", "hostname"}
+		return fmt.Sprintf("SELECT %s, SUM(count) AS messages, SUM(CASE WHEN %s THEN count ELSE 0 END) AS passing, %s AS breaks_adkim_s, %s AS breaks_aspf_s, %s AS breaks_strict, MAX(date_range_end) AS last_observed FROM records WHERE %s GROUP BY %s HAVING %s > 0 ORDER BY breaks_strict DESC",
+			selectGrouped(cols...), passesNow(), breaksWhen(passesStrictDKIM()), breaksWhen(passesStrictSPF()), breaksWhen(passesStrict), where, groupBy(cols...), breaksWhen(passesStrict))
+	},
+	// how each of our domains is faring overall
+	"summary": func(where string) string {
+		return fmt.Sprintf("SELECT %s, SUM(count) AS messages, SUM(CASE WHEN %s THEN count ELSE 0 END) AS passing, SUM(CASE WHEN %s = 'quarantine' THEN count ELSE 0 END) AS quarantined, SUM(CASE WHEN %s = 'reject' THEN count ELSE 0 END) AS rejected, COUNT(DISTINCT %s) AS reporters, COUNT(DISTINCT %s) AS sources, MAX(date_range_end) AS last_observed FROM records WHERE %s GROUP BY %s ORDER BY messages DESC", selectGrouped("domain"), evaluatedPass(), textCol("disposition"), textCol("disposition"), textCol("org_name"), textCol("source_ip"), where, groupBy("domain"))
+	},
+}
+
+func groupBy(cols ...string) string {
+	exprs := make([]string, len(cols))
+	for i, col := range cols {
+		exprs[i] = textCol(col)
+	}
+	return strings.Join(exprs, ", ")
+}
+
+// whether a record passed DMARC, as evaluated by its reporter
+func evaluatedPass() string {
+	return fmt.Sprintf("(%s = 'pass' OR %s = 'pass')", textCol("dkim"), textCol("spf"))
+}
+
+// selects grouped columns under their own names
+func selectGrouped(cols ...string) string {
+	exprs := make([]string, len(cols))
+	for i, col := range cols {
+		exprs[i] = textCol(col)
+		if exprs[i] != col {
+			exprs[i] += " AS " + col
+		}
+	}
+	return strings.Join(exprs, ", ")
+}
+
+// handles `dmarcdb report <fails|top-senders|alignment|summary> [--since 30d] [--domain wvu.edu] [--format table|csv|json] [--limit 50]`
+func reports(args ...string) error {
+	if len(args) == 0 || reportQueries[args[0]] == nil {
+		return fmt.Errorf("Usage: dmarcdb report <fails|top-senders|alignment|summary> [--since 30d] [--domain example.com] [--format table|csv|json] [--limit 50]")
+	}
+
+	var (
+		flags  = flag.NewFlagSet("report "+args[0], flag.ContinueOnError)
+		since  = flags.String("since", "30d", "only records reported since, i.e. 30d or 2018-01-31 (\"\" for all)")
+		domain = flags.String("domain", "", "only records for this domain")
+		format = flags.String("format", "table", "output format, table, csv or json")
+		max    = flags.Int("limit", 50, "most rows to print (0 for all)")
+	)
+	if err := flags.Parse(args[1:]); err != nil {
+		return err
+	}
+
+	sinceTime, err := parseSince(*since)
+	if err != nil {
+		return err
+	}
+	dateCol := "date_range_begin"
+	if rollupReports[args[0]] {
+		dateCol = "day"
+		sinceTime = sinceTime.UTC().Truncate(day)
+	}
+	var (
+		conds  = []string{dateCol + " >= $1"}
+		params = []interface{}{sinceTime.Unix()}
+	)
+	if sinceTime.IsZero() {
+		params[0] = int64(0)
+	}
+	if *domain != "" {
+		conds = append(conds, textCol("domain")+" = $2")
+		params = append(params, *domain)
+	}
+
+	query := reportQueries[args[0]](strings.Join(conds, " AND "))
+	if *max > 0 {
+		query = limit(query, *max)
+	}
+	columns, rows, err := queryReport(rebind(query), params...)
+	if err != nil {
+		return err
+	}
+
+	switch *format {
+	case "table":
+		return printTable(columns, rows)
+	case "csv":
+		return printCSV(columns, rows)
+	case "json":
+		return printJSON(columns, rows)
+	default:
+		return fmt.Errorf("Unknown report format \"%s\", expected table, csv or json", *format)
+	}
+}
+
+// runs a report's query, returning its column names and rows with dates formatted and byte strings as strings
+func queryReport(query string, params ...interface{}) ([]string, [][]interface{}, error) {
+	rows, err := db.Query(query, params...)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var results [][]interface{}
+	for rows.Next() {
+		vals := make([]interface{}, len(columns))
+		ptrs := make([]interface{}, len(columns))
+		for i := range vals {
+			ptrs[i] = &vals[i]
+		}
+		if err = rows.Scan(ptrs...); err != nil {
+			return nil, nil, err
+		}
+		for i, val := range vals {
+			if b, ok := val.([]byte); ok {
+				val = string(b)
+			}
+			// timestamps are stored as unix seconds, and printed as dates whatever the database
+			if strings.HasSuffix(columns[i], "_observed") {
+				if n, ok := val.(int64); ok {
+					val = time.Unix(n, 0).UTC().Format("2006-01-02")
+				}
+			}
+			vals[i] = val
+		}
+		results = append(results, vals)
+	}
+	return columns, results, rows.Err()
+}
+
+func formatValue(val interface{}) string {
+	switch v := val.(type) {
+	case nil:
+		return ""
+	case int64:
+		return strconv.FormatInt(v, 10)
+	case float64:
+		// rolled up messages are spread over days, so are fractional
+		return strconv.FormatFloat(v, 'f', 0, 64)
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+func printTable(columns []string, rows [][]interface{}) error {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, strings.ToUpper(strings.Join(columns, "\t")))
+	for _, row := range rows {
+		vals := make([]string, len(row))
+		for i, val := range row {
+			vals[i] = formatValue(val)
+		}
+		fmt.Fprintln(w, strings.Join(vals, "\t"))
+	}
+	return w.Flush()
+}
+
+func printCSV(columns []string, rows [][]interface{}) error {
+	w := csv.NewWriter(os.Stdout)
+	if err := w.Write(columns); err != nil {
+		return err
+	}
+	for _, row := range rows {
+		vals := make([]string, len(row))
+		for i, val := range row {
+			vals[i] = formatValue(val)
+		}
+		if err := w.Write(vals); err != nil {
+			return err
+		}
+	}
+	w.Flush()
+	return w.Error()
+}
+
+func printJSON(columns []string, rows [][]interface{}) error {
+	objs := make([]map[string]interface{}, len(rows))
+	for i, row := range rows {
+		objs[i] = map[string]interface{}{}
+		for j, col := range columns {
+			objs[i][col] = row[j]
+		}
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(objs)
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// the dimensions of the "daily_rollup" table, each row of which holds the messages reported on a UTC day
+var rollupCols = []string{"domain", "source_ip", "asn", "sender", "hostname", "location", "dkim", "spf", "disposition"}
+
+// how far the rollup has got, kept in the "rollups" bucket. Changed is the earliest date_range_begin of the records
+// changed in place (i.e. by reenrich) since, which is zero when there are none
+type rollupState struct {
+	LastID  int64     `json:"last_id"`
+	Changed time.Time `json:"changed"`
+	Updated time.Time `json:"updated"`
+}
+
+// handles `dmarcdb rollup [--full]`, bringing the daily rollup up to date with the records stored since it last ran
+func rollupCmd(ctx context.Context, args ...string) error {
+	var (
+		flags = flag.NewFlagSet("rollup", flag.ContinueOnError)
+		full  = flags.Bool("full", false, "rebuild the whole rollup from every stored record")
+	)
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	return rollup(ctx, *full)
+}
+
+// re-rolls every day from the earliest one touched by the records stored since the last rollup, or by those changed
+// in place since (see rerollFrom). New records are told by their ids, which are handed out before the reports storing
+// them commit, so the highest one is only read once none are being stored; other dmarcdb processes can't be storing
+// any as they'd hold the bolt lock
+func rollup(ctx context.Context, full bool) error {
+	state, err := loadRollupState()
+	if err != nil {
+		return err
+	}
+	after := state.LastID
+	if full {
+		after = 0
+	}
+
+	var lastID, earliest sql.NullInt64
+	storing.Lock()
+	err = db.QueryRowContext(ctx, rebind("SELECT MAX(id), MIN(date_range_begin) FROM records WHERE id > $1"), after).Scan(&lastID, &earliest)
+	storing.Unlock()
+	if err != nil {
+		return err
+	}
+
+	var start time.Time
+	switch {
+	case lastID.Valid && (state.Changed.IsZero() || full || earliest.Int64 < state.Changed.Unix()):
+		start = time.Unix(earliest.Int64, 0)
+	case !state.Changed.IsZero():
+		start = state.Changed
+		if !lastID.Valid {
+			lastID = sql.NullInt64{Int64: state.LastID, Valid: true}
+		}
+	default:
+		fmt.Println("Daily rollup is up to date")
+		return nil
+	}
+	start = start.UTC().Truncate(day)
+	// days whose records may have been pruned are left as they were rolled up
+	cutoff, err := retentionCutoff("retainRecords")
+	if err != nil {
+		return err
+	}
+	if !cutoff.IsZero() && start.Before(cutoff) {
+		start = cutoff.UTC().Truncate(day).Add(day)
+	}
+
+	started := time.Now()
+	txn, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			txn.Rollback()
+		}
+	}()
+
+	if _, err = txn.Exec(rebind("DELETE FROM daily_rollup WHERE day >= $1"), start.Unix()); err != nil {
+		return err
+	}
+	rows, err := rollupRecords(ctx, txn, start, lastID.Int64)
+	if err != nil {
+		return err
+	}
+
+	stmt, err := copyIn(txn, "daily_rollup", append([]string{"day"}, append(rollupCols, "messages")...)...)
+	if err != nil {
+		return err
+	}
+	for r, messages := range rows {
+		if _, err = stmt.Exec(r.day, r.domain, r.sourceIP, r.asn, r.sender, r.hostname, r.location, r.dkim, r.spf, r.disposition, messages); err != nil {
+			stmt.Close()
+			return err
+		}
+	}
+	if _, err = stmt.Exec(); err != nil {
+		return err
+	}
+	if err = stmt.Close(); err != nil {
+		return err
+	}
+	if err = txn.Commit(); err != nil {
+		return err
+	}
+
+	fmt.Printf("Rolled up %d days from %s into %d rows, took %s\n", int(time.Since(start)/day)+1, start.Format("2006-01-02"), len(rows), time.Since(started))
+	return bdb.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("rollups"))
+		next := rollupState{LastID: lastID.Int64, Updated: time.Now()}
+		// keep what was changed while rolling up for next time
+		var cur rollupState
+		if v := b.Get([]byte("daily")); v != nil {
+			if err := json.Unmarshal(v, &cur); err != nil {
+				return err
+			}
+		}
+		if !cur.Changed.Equal(state.Changed) {
+			next.Changed = cur.Changed
+		}
+		v, err := json.Marshal(next)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte("daily"), v)
+	})
+}
+
+// reads how far the rollup has got
+func loadRollupState() (state rollupState, err error) {
+	err = bdb.View(func(tx *bolt.Tx) error {
+		if v := tx.Bucket([]byte("rollups")).Get([]byte("daily")); v != nil {
+			return json.Unmarshal(v, &state)
+		}
+		return nil
+	})
+	return
+}
+
+// notes that records reported from begin on have had their rolled up columns changed in place, so the next rollup
+// re-rolls their days rather than only those of new records
+func rerollFrom(begin time.Time) error {
+	return bdb.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("rollups"))
+		var state rollupState
+		if v := b.Get([]byte("daily")); v != nil {
+			if err := json.Unmarshal(v, &state); err != nil {
+				return err
+			}
+		}
+		if !state.Changed.IsZero() && !begin.Before(state.Changed) {
+			return nil
+		}
+		state.Changed = begin
+		v, err := json.Marshal(state)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte("daily"), v)
+	})
+}
+
+type rollupRow struct {
+	day                                                                  int64
+	domain, sourceIP, sender, hostname, location, dkim, spf, disposition string
+	asn                                                                  sql.NullInt64
+}
+
+// sums the records up to lastID whose date ranges reach into the days from start, spreading each over its days
+func rollupRecords(ctx context.Context, txn *sql.Tx, start time.Time, lastID int64) (map[rollupRow]float64, error) {
+	dims := []string{"domain", "source_ip", "sender", "hostname", "location", "dkim", "spf", "disposition"}
+	query := fmt.Sprintf("SELECT %s, asn, date_range_begin, date_range_end, SUM(count) FROM records WHERE date_range_end >= $1 AND id <= $2 GROUP BY %s, asn, date_range_begin, date_range_end",
+		selectGrouped(dims...), groupBy(dims...))
+	rows, err := txn.QueryContext(ctx, rebind(query), start.Unix(), lastID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sums := map[rollupRow]float64{}
+	for rows.Next() {
+		var (
+			vals       = make([]sql.NullString, len(dims))
+			asn, count sql.NullInt64
+			begin, end int64
+			dest       []interface{}
+		)
+		for i := range vals {
+			dest = append(dest, &vals[i])
+		}
+		if err = rows.Scan(append(dest, &asn, &begin, &end, &count)...); err != nil {
+			return nil, err
+		}
+
+		r := rollupRow{0, vals[0].String, vals[1].String, vals[2].String, vals[3].String, vals[4].String, vals[5].String, vals[6].String, vals[7].String, asn}
+		for d, n := range spreadDays(begin, end, float64(count.Int64)) {
+			if d.Before(start) {
+				continue
+			}
+			r.day = d.Unix()
+			sums[r] += n
+		}
+	}
+	return sums, rows.Err()
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+var (
+	senderRules    []senderRule
+	senderStatuses = []string{"authorized", "unknown", "blocked"}
+)
+
+// senderRule maps source networks to a named sender (i.e. an ESP or vendor)
+type senderRule struct {
+	Name   string   `json:"name"`
+	Status string   `json:"status"`
+	ASNs   []uint   `json:"asns,omitempty"`
+	CIDRs  []string `json:"cidrs,omitempty"`
+	PTR    []string `json:"ptr,omitempty"`
+}
+
+// reports whether the rule matches a source by network, ASN or PTR suffix
+func (rule senderRule) matches(ip net.IP, asn uint, host string) bool {
+	for _, cidr := range rule.CIDRs {
+		if _, network, err := net.ParseCIDR(cidr); err == nil && network.Contains(ip) {
+			return true
+		}
+	}
+	for _, n := range rule.ASNs {
+		if asn != 0 && n == asn {
+			return true
+		}
+	}
+	for _, name := range strings.Split(host, ",") {
+		name = strings.ToLower(strings.TrimSuffix(name, "."))
+		for _, suffix := range rule.PTR {
+			// match on a label boundary, so mcsv.net doesn't match evilmcsv.net
+			suffix = strings.ToLower(strings.Trim(suffix, "."))
+			if name != "" && suffix != "" && (name == suffix || strings.HasSuffix(name, "."+suffix)) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (rule senderRule) String() string {
+	return fmt.Sprintf("%s (%s)", rule.Name, rule.Status)
+}
+
+// classifies a source with the first matching sender rule, or returns "" if none match
+func classifySender(ip net.IP, asn uint, host string) string {
+	for _, rule := range senderRules {
+		if rule.matches(ip, asn, host) {
+			return rule.String()
+		}
+	}
+	return ""
+}
+
+// senderEnricher classifies a record's source with the sender rules, using the geoip and hostname attributes
+type senderEnricher struct{}
+
+func (senderEnricher) Name() string { return "sender" }
+
+func (senderEnricher) Network() bool { return false }
+
+func (senderEnricher) Enrich(ctx context.Context, report *DMARCFeedback, record DMARCRecord, attrs Attributes) (Attributes, error) {
+	asn, _ := strconv.ParseUint(attrs["asn"], 10, 32)
+	if sender := classifySender(net.ParseIP(record.SourceIP), uint(asn), attrs["hostname"]); sender != "" {
+		return Attributes{"sender": sender}, nil
+	}
+	return nil, nil
+}
+
+// reads the configured sender rules file, a missing file means no rules
+func loadSenderRules() ([]senderRule, error) {
+	rules := []senderRule{}
+	b, err := ioutil.ReadFile(viper.GetString("senderRules"))
+	if os.IsNotExist(err) {
+		return rules, nil
+	} else if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(b, &rules)
+	return rules, err
+}
+
+func saveSenderRules(rules []senderRule) error {
+	b, err := json.MarshalIndent(rules, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(viper.GetString("senderRules"), b, 0644)
+}
+
+// handles `dmarcdb senders [list|add|remove]`
+func senders(args ...string) error {
+	if len(args) == 0 || args[0] == "list" {
+		for _, rule := range senderRules {
+			fmt.Printf("%s\n\tasns: %v\n\tcidrs: %s\n\tptr: %s\n", rule, rule.ASNs, strings.Join(rule.CIDRs, ", "), strings.Join(rule.PTR, ", "))
+		}
+		return nil
+	}
+
+	switch args[0] {
+	// i.e. `dmarcdb senders add Mailchimp authorized AS14086 205.201.128.0/20 .mcsv.net`
+	case "add":
+		if len(args) < 3 {
+			return fmt.Errorf("usage: senders add <name> <%s> [ASN|CIDR|PTR suffix]...", strings.Join(senderStatuses, "|"))
+		}
+		if !isSenderStatus(args[2]) {
+			return fmt.Errorf("Sender status \"%s\" must be one of %s", args[2], strings.Join(senderStatuses, ", "))
+		}
+
+		idx := findSenderRule(args[1])
+		if idx == -1 {
+			senderRules = append(senderRules, senderRule{Name: args[1]})
+			idx = len(senderRules) - 1
+		}
+		rule := &senderRules[idx]
+		rule.Status = args[2]
+
+		for _, match := range args[3:] {
+			if _, _, err := net.ParseCIDR(match); err == nil {
+				rule.CIDRs = append(rule.CIDRs, match)
+			} else if n, err := strconv.ParseUint(strings.TrimPrefix(strings.ToUpper(match), "AS"), 10, 32); err == nil {
+				rule.ASNs = append(rule.ASNs, uint(n))
+			} else {
+				rule.PTR = append(rule.PTR, match)
+			}
+		}
+		fmt.Printf("Saved sender %s\n", rule)
+	case "remove":
+		if len(args) < 2 {
+			return fmt.Errorf("usage: senders remove <name>")
+		}
+		idx := findSenderRule(args[1])
+		if idx == -1 {
+			return fmt.Errorf("No sender named \"%s\"", args[1])
+		}
+		senderRules = append(senderRules[:idx], senderRules[idx+1:]...)
+		fmt.Printf("Removed sender %s\n", args[1])
+	default:
+		return fmt.Errorf("The senders option \"%v\" is not yet available", args[0])
+	}
+
+	return saveSenderRules(senderRules)
+}
+
+func findSenderRule(name string) int {
+	for i, rule := range senderRules {
+		if strings.EqualFold(rule.Name, name) {
+			return i
+		}
+	}
+	return -1
+}
+
+func isSenderStatus(status string) bool {
+	for _, s := range senderStatuses {
+		if s == status {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// dnsSnapshot is what one of our domains published in DNS from ObservedAt onwards
+type dnsSnapshot struct {
+	Domain     string
+	ObservedAt int64
+	DMARC      string
+	SPF        string
+	DKIM       string
+	Policy     DMARCPolicy
+}
+
+// handles `dmarcdb dns-snapshot [drift]`
+func dnsSnapshots(ctx context.Context, args ...string) error {
+	if len(args) > 0 {
+		switch args[0] {
+		case "drift":
+			return printDrift()
+		default:
+			return fmt.Errorf("The dns-snapshot option \"%v\" is not yet available", args[0])
+		}
+	}
+
+	domains := viper.GetStringSlice("domains")
+	if len(domains) == 0 {
+		return fmt.Errorf("No domains configured to snapshot")
+	}
+
+	for _, domain := range domains {
+		snap, err := takeSnapshot(ctx, domain)
+		if err != nil {
+			return err
+		}
+
+		last, err := snapshotsAt(domain, snap.ObservedAt, 1)
+		if err != nil {
+			return err
+		}
+		if len(last) > 0 && last[0].DMARC == snap.DMARC && last[0].SPF == snap.SPF && last[0].DKIM == snap.DKIM {
+			fmt.Printf("%s unchanged since %s\n", domain, time.Unix(last[0].ObservedAt, 0).Format(time.RFC3339))
+			continue
+		}
+
+		// only changes are stored, so each snapshot is valid until the next one for its domain
+		_, err = db.Exec(rebind("INSERT INTO dns_snapshots (domain, observed_at, dmarc, spf, dkim, p, pct, adkim, aspf) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)"),
+			snap.Domain, snap.ObservedAt, snap.DMARC, snap.SPF, snap.DKIM, snap.Policy.P, snap.Policy.PCT, snap.Policy.ADKIM, snap.Policy.ASPF)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%s changed: p=%s pct=%d adkim=%s aspf=%s\n", domain, snap.Policy.P, snap.Policy.PCT, snap.Policy.ADKIM, snap.Policy.ASPF)
+	}
+	return nil
+}
+
+// looks up the _dmarc, SPF and configured DKIM selector records currently published for domain
+func takeSnapshot(ctx context.Context, domain string) (*dnsSnapshot, error) {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	snap := &dnsSnapshot{
+		Domain:     domain,
+		ObservedAt: time.Now().Unix(),
+	}
+
+	txts, err := lookupTXT(ctx, "_dmarc."+domain)
+	if err != nil {
+		return nil, err
+	}
+	for _, txt := range txts {
+		if strings.HasPrefix(strings.ToLower(txt), "v=dmarc1") {
+			snap.DMARC = txt
+		}
+	}
+	snap.Policy = parseDMARCRecord(domain, snap.DMARC)
+
+	txts, err = lookupTXT(ctx, domain)
+	if err != nil {
+		return nil, err
+	}
+	for _, txt := range txts {
+		if lower := strings.ToLower(txt); lower == "v=spf1" || strings.HasPrefix(lower, "v=spf1 ") {
+			snap.SPF = txt
+		}
+	}
+
+	var dkim []string
+	for _, selector := range viper.GetStringSlice("dkimSelectors") {
+		txts, err = lookupTXT(ctx, selector+"._domainkey."+domain)
+		if err != nil {
+			return nil, err
+		}
+		if len(txts) > 0 {
+			dkim = append(dkim, selector+": "+strings.Join(txts, ""))
+		}
+	}
+	sort.Strings(dkim)
+	snap.DKIM = strings.Join(dkim, "\n")
+
+	return snap, nil
+}
+
+// looks up TXT records, treating a missing name as having none
+func lookupTXT(ctx context.Context, name string) ([]string, error) {
+	txts, err := defaultResoler.LookupTXT(ctx, name)
+	if isNotFound(err) {
+		return nil, nil
+	}
+	return txts, err
+}
+
+// parses the policy tags of a DMARC record, applying the defaults of RFC 7489 section 6.3
+func parseDMARCRecord(domain, record string) DMARCPolicy {
+	policy := DMARCPolicy{
+		Domain: domain,
+		ADKIM:  "r",
+		ASPF:   "r",
+		PCT:    100,
+	}
+	if record == "" {
+		policy.P = "none"
+		return policy
+	}
+
+	for _, tag := range strings.Split(record, ";") {
+		kv := strings.SplitN(strings.TrimSpace(tag), "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		val := strings.ToLower(strings.TrimSpace(kv[1]))
+		switch strings.ToLower(strings.TrimSpace(kv[0])) {
+		case "p":
+			policy.P = val
+		case "pct":
+			if pct, err := strconv.Atoi(val); err == nil {
+				policy.PCT = pct
+			}
+		case "adkim":
+			policy.ADKIM = val
+		case "aspf":
+			policy.ASPF = val
+		}
+	}
+	return policy
+}
+
+// returns up to n snapshots of domain observed at or before t, newest first
+func snapshotsAt(domain string, t int64, n int) ([]dnsSnapshot, error) {
+	query := limit("SELECT domain, observed_at, dmarc, spf, dkim, p, pct, adkim, aspf FROM dns_snapshots WHERE domain = $1 AND observed_at <= $2 ORDER BY observed_at DESC", n)
+	rows, err := db.Query(rebind(query), domain, t)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var snaps []dnsSnapshot
+	for rows.Next() {
+		var (
+			snap             dnsSnapshot
+			dmarc, spf, dkim sql.NullString
+		)
+		err = rows.Scan(&snap.Domain, &snap.ObservedAt, &dmarc, &spf, &dkim, &snap.Policy.P, &snap.Policy.PCT, &snap.Policy.ADKIM, &snap.Policy.ASPF)
+		if err != nil {
+			return nil, err
+		}
+		snap.DMARC, snap.SPF, snap.DKIM = dmarc.String, spf.String, dkim.String
+		snap.Policy.Domain = snap.Domain
+		snaps = append(snaps, snap)
+	}
+	return snaps, rows.Err()
+}
+
+// compares the policy a receiver saw against every snapshot valid during the report's date range,
+// returning a description of the disagreement or "" if it matches any of them (or none are known)
+func (report *DMARCFeedback) policyDrift() (string, error) {
+	snaps, err := snapshotsAt(report.Policy.Domain, report.Metadata.DateRangeEnd, 100)
+	if err != nil || len(snaps) == 0 {
+		return "", err
+	}
+
+	var drift string
+	for _, snap := range snaps {
+		drift = comparePolicy(report.Policy, snap.Policy)
+		if drift == "" || snap.ObservedAt <= report.Metadata.DateRangeBegin {
+			break
+		}
+	}
+	return drift, nil
+}
+
+// describes how a reported policy differs from the published one, i.e. "p=none (published reject)"
+func comparePolicy(reported, published DMARCPolicy) string {
+	reported, published = reported.withDefaults(), published.withDefaults()
+	var diffs []string
+	diff := func(tag, got, want string) {
+		if !strings.EqualFold(got, want) {
+			diffs = append(diffs, fmt.Sprintf("%s=%s (published %s)", tag, got, want))
+		}
+	}
+	diff("p", reported.P, published.P)
+	diff("pct", strconv.Itoa(reported.PCT), strconv.Itoa(published.PCT))
+	diff("adkim", reported.ADKIM, published.ADKIM)
+	diff("aspf", reported.ASPF, published.ASPF)
+	return strings.Join(diffs, ", ")
+}
+
+// fills in the tags a report or record may leave out (or reports as NULL) with the defaults of RFC 7489 section 6.3,
+// so a missing tag isn't taken for a different one
+func (policy DMARCPolicy) withDefaults() DMARCPolicy {
+	for _, tag := range []*string{&policy.ADKIM, &policy.ASPF} {
+		if *tag == "" || strings.EqualFold(*tag, "NULL") {
+			*tag = "r"
+		}
+	}
+	if policy.PCT < 0 || policy.PCT > 100 {
+		policy.PCT = 100
+	}
+	return policy
+}
+
+// lists reports whose published policy disagreed with our snapshots
+func printDrift() error {
+	cols := fmt.Sprintf("%s, %s, date_range_begin, %s", textCol("org_name"), textCol("domain"), textCol("policy_drift"))
+	rows, err := db.Query(fmt.Sprintf("SELECT %[1]s, SUM(count) FROM records WHERE %[2]s <> '' GROUP BY %[1]s ORDER BY date_range_begin DESC", cols, textCol("policy_drift")))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "REPORTER\tDOMAIN\tDATE\tDRIFT\tMESSAGES")
+	for rows.Next() {
+		var (
+			org, domain, drift sql.NullString
+			begin, count       sql.NullInt64
+		)
+		if err = rows.Scan(&org, &domain, &begin, &drift, &count); err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d\n", org.String, domain.String, time.Unix(begin.Int64, 0).UTC().Format("2006-01-02"), drift.String, count.Int64)
+	}
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	return w.Flush()
+}
@@ -0,0 +1,595 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// spfLookupLimit is the maximum number of DNS querying terms allowed by RFC 7208 section 4.6.4
+	spfLookupLimit = 10
+	// spfVoidLimit is the maximum number of lookups which may find nothing, by the same section
+	spfVoidLimit = 2
+)
+
+var (
+	spfChecker *spfEvaluator
+
+	errMultipleSPF = errors.New("domain publishes more than one SPF record")
+
+	// results of each SPF qualifier
+	spfQualifiers = map[byte]string{'+': "pass", '-': "fail", '~': "softfail", '?': "neutral"}
+)
+
+// spfResolver is the subset of *net.Resolver needed to evaluate SPF records, so a stub can stand in for DNS
+type spfResolver interface {
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+	LookupMX(ctx context.Context, name string) ([]*net.MX, error)
+	LookupAddr(ctx context.Context, addr string) ([]string, error)
+}
+
+// spfEvaluation is the result of checking a source IP against a domain's published SPF record
+type spfEvaluation struct {
+	Result    string
+	Mechanism string
+	Lookups   int
+}
+
+// reports whether the domain's whole SPF include tree needs more DNS lookups than allowed
+func (eval spfEvaluation) ExceedsLimit() bool {
+	return eval.Lookups > spfLookupLimit
+}
+
+// spfEvaluator checks source IPs against published SPF records, caching DNS answers for ttl
+type spfEvaluator struct {
+	resolver spfResolver
+	ttl      time.Duration
+	mu       sync.Mutex
+	cache    map[string]spfAnswer
+	swept    time.Time
+}
+
+type spfAnswer struct {
+	val     interface{}
+	err     error
+	expires time.Time
+}
+
+// the DNS lookups made evaluating one source, counted against the limits
+type spfCounts struct {
+	lookups, voids int
+}
+
+// counts a DNS querying term, reporting whether it's over the limit
+func (c *spfCounts) lookup() bool {
+	c.lookups++
+	return c.lookups > spfLookupLimit
+}
+
+// counts a lookup which found nothing, reporting whether it's over the limit
+func (c *spfCounts) void() bool {
+	c.voids++
+	return c.voids > spfVoidLimit
+}
+
+func newSPFEvaluator(resolver spfResolver, ttl time.Duration) *spfEvaluator {
+	return &spfEvaluator{
+		resolver: resolver,
+		ttl:      ttl,
+		cache:    map[string]spfAnswer{},
+		swept:    time.Now(),
+	}
+}
+
+// evaluates ip against domain's SPF record as it is published today
+func (e *spfEvaluator) evaluate(ctx context.Context, ip net.IP, domain string) spfEvaluation {
+	result, mechanism := e.checkHost(ctx, ip, domain, &spfCounts{}, 0)
+	return spfEvaluation{
+		Result:    result,
+		Mechanism: mechanism,
+		Lookups:   e.countLookups(ctx, domain, 0, 0),
+	}
+}
+
+// implements check_host() from RFC 7208 section 4, returning the result and the chain of matched mechanisms
+func (e *spfEvaluator) checkHost(ctx context.Context, ip net.IP, domain string, counts *spfCounts, depth int) (string, string) {
+	if depth > spfLookupLimit {
+		return "permerror", ""
+	}
+
+	record, err := e.record(ctx, domain)
+	if err == errMultipleSPF {
+		return "permerror", ""
+	} else if err != nil {
+		return "temperror", ""
+	} else if record == "" {
+		return "none", ""
+	}
+
+	var redirect string
+	for _, term := range strings.Fields(record)[1:] {
+		if strings.HasPrefix(strings.ToLower(term), "redirect=") {
+			redirect = term[len("redirect="):]
+			continue
+		} else if strings.Contains(term, "=") {
+			// other modifiers (i.e. exp=) don't affect the result
+			continue
+		}
+
+		qualifier := byte('+')
+		if _, ok := spfQualifiers[term[0]]; ok {
+			qualifier, term = term[0], term[1:]
+		}
+
+		matched, chain, result := e.mechanism(ctx, ip, domain, term, counts, depth)
+		if result != "" {
+			return result, term
+		}
+		if matched {
+			return spfQualifiers[qualifier], chain
+		}
+	}
+
+	if redirect != "" {
+		if counts.lookup() {
+			return "permerror", "redirect=" + redirect
+		}
+		result, chain := e.checkHost(ctx, ip, expandSPFMacros(redirect, ip, domain), counts, depth+1)
+		if result == "none" {
+			result = "permerror"
+		}
+		return result, joinSPFChain("redirect="+redirect, chain)
+	}
+
+	return "neutral", ""
+}
+
+// evaluates a single mechanism, returning whether it matched, the matched chain, and an error result if any
+func (e *spfEvaluator) mechanism(ctx context.Context, ip net.IP, domain, term string, counts *spfCounts, depth int) (bool, string, string) {
+	var (
+		name = strings.ToLower(term)
+		arg  string
+	)
+	if idx := strings.IndexAny(term, ":/"); idx != -1 {
+		name, arg = strings.ToLower(term[:idx]), term[idx:]
+	}
+
+	// every mechanism other than all, ip4 and ip6 counts towards the DNS lookup limit
+	switch name {
+	case "all", "ip4", "ip6":
+	default:
+		if counts.lookup() {
+			return false, "", "permerror"
+		}
+	}
+
+	switch name {
+	case "all":
+		return true, term, ""
+	case "ip4", "ip6":
+		network, err := parseSPFNetwork(strings.TrimPrefix(arg, ":"), name == "ip4")
+		if err != nil {
+			return false, "", "permerror"
+		}
+		return network.Contains(ip) && (ip.To4() != nil) == (name == "ip4"), term, ""
+	case "include":
+		target := strings.TrimPrefix(arg, ":")
+		if target == "" {
+			return false, "", "permerror"
+		}
+		switch result, chain := e.checkHost(ctx, ip, expandSPFMacros(target, ip, domain), counts, depth+1); result {
+		case "pass":
+			return true, joinSPFChain(term, chain), ""
+		case "temperror":
+			return false, "", "temperror"
+		case "permerror", "none":
+			return false, "", "permerror"
+		}
+		return false, "", ""
+	case "a", "mx":
+		target, v4, v6, err := parseSPFDualCIDR(arg, domain)
+		if err != nil {
+			return false, "", "permerror"
+		}
+		target = expandSPFMacros(target, ip, domain)
+
+		hosts := []string{target}
+		if name == "mx" {
+			mxs, err := e.lookupMX(ctx, target)
+			if err != nil {
+				return false, "", "temperror"
+			}
+			if len(mxs) > spfLookupLimit {
+				return false, "", "permerror"
+			}
+			if len(mxs) == 0 && counts.void() {
+				return false, "", "permerror"
+			}
+			hosts = mxs
+		}
+
+		for _, host := range hosts {
+			addrs, err := e.lookupIP(ctx, host)
+			if err != nil {
+				return false, "", "temperror"
+			}
+			if name == "a" && len(addrs) == 0 && counts.void() {
+				return false, "", "permerror"
+			}
+			for _, addr := range addrs {
+				if spfCIDRMatch(ip, addr, v4, v6) {
+					return true, term, ""
+				}
+			}
+		}
+		return false, "", ""
+	case "ptr":
+		target := expandSPFMacros(strings.TrimPrefix(arg, ":"), ip, domain)
+		if target == "" {
+			target = domain
+		}
+		names, err := e.lookupPTR(ctx, ip.String())
+		if err != nil {
+			return false, "", ""
+		}
+		if len(names) == 0 && counts.void() {
+			return false, "", "permerror"
+		}
+		for i, host := range names {
+			if i >= spfLookupLimit {
+				break
+			}
+			host = strings.ToLower(strings.TrimSuffix(host, "."))
+			if host != strings.ToLower(target) && !strings.HasSuffix(host, "."+strings.ToLower(target)) {
+				continue
+			}
+			// only a validated PTR name (one which resolves back to ip) counts
+			addrs, _ := e.lookupIP(ctx, host)
+			for _, addr := range addrs {
+				if addr.Equal(ip) {
+					return true, term, ""
+				}
+			}
+		}
+		return false, "", ""
+	case "exists":
+		target := strings.TrimPrefix(arg, ":")
+		if target == "" {
+			return false, "", "permerror"
+		}
+		addrs, err := e.lookupIP(ctx, expandSPFMacros(target, ip, domain))
+		if err != nil {
+			return false, "", "temperror"
+		}
+		if len(addrs) == 0 && counts.void() {
+			return false, "", "permerror"
+		}
+		for _, addr := range addrs {
+			if addr.To4() != nil {
+				return true, term, ""
+			}
+		}
+		return false, "", ""
+	}
+
+	return false, "", "permerror"
+}
+
+// counts the DNS querying terms in domain's whole SPF include tree, regardless of which source is evaluated,
+// adding to count. It stops once the count is over the limit or ctx is done, so a wide include tree can't cost
+// more than a few lookups past the limit
+func (e *spfEvaluator) countLookups(ctx context.Context, domain string, count, depth int) int {
+	record, err := e.record(ctx, domain)
+	if err != nil || record == "" || depth > spfLookupLimit {
+		return count
+	}
+
+	for _, term := range strings.Fields(record)[1:] {
+		if count > spfLookupLimit || ctx.Err() != nil {
+			return count
+		}
+		term = strings.ToLower(strings.TrimLeft(term, "+-~?"))
+		switch {
+		case strings.HasPrefix(term, "include:"):
+			count = e.countLookups(ctx, term[len("include:"):], count+1, depth+1)
+		case strings.HasPrefix(term, "redirect="):
+			count = e.countLookups(ctx, term[len("redirect="):], count+1, depth+1)
+		case term == "a", term == "mx", term == "ptr",
+			strings.HasPrefix(term, "a:"), strings.HasPrefix(term, "a/"),
+			strings.HasPrefix(term, "mx:"), strings.HasPrefix(term, "mx/"),
+			strings.HasPrefix(term, "ptr:"), strings.HasPrefix(term, "exists:"):
+			count++
+		}
+	}
+	return count
+}
+
+// fetches domain's SPF record, or "" if it doesn't publish one
+func (e *spfEvaluator) record(ctx context.Context, domain string) (string, error) {
+	v, err := e.cached(ctx, "txt:"+domain, func() (interface{}, error) {
+		txts, err := e.resolver.LookupTXT(ctx, domain)
+		if isNotFound(err) {
+			return "", nil
+		} else if err != nil {
+			return "", err
+		}
+
+		var record string
+		for _, txt := range txts {
+			if lower := strings.ToLower(txt); lower == "v=spf1" || strings.HasPrefix(lower, "v=spf1 ") {
+				if record != "" {
+					return "", errMultipleSPF
+				}
+				record = txt
+			}
+		}
+		return record, nil
+	})
+	return v.(string), err
+}
+
+func (e *spfEvaluator) lookupIP(ctx context.Context, host string) ([]net.IP, error) {
+	v, err := e.cached(ctx, "ip:"+host, func() (interface{}, error) {
+		addrs, err := e.resolver.LookupIPAddr(ctx, host)
+		if isNotFound(err) {
+			err = nil
+		}
+		ips := make([]net.IP, len(addrs))
+		for i, addr := range addrs {
+			ips[i] = addr.IP
+		}
+		return ips, err
+	})
+	return v.([]net.IP), err
+}
+
+func (e *spfEvaluator) lookupMX(ctx context.Context, host string) ([]string, error) {
+	v, err := e.cached(ctx, "mx:"+host, func() (interface{}, error) {
+		mxs, err := e.resolver.LookupMX(ctx, host)
+		if isNotFound(err) {
+			err = nil
+		}
+		hosts := make([]string, len(mxs))
+		for i, mx := range mxs {
+			hosts[i] = mx.Host
+		}
+		return hosts, err
+	})
+	return v.([]string), err
+}
+
+func (e *spfEvaluator) lookupPTR(ctx context.Context, addr string) ([]string, error) {
+	v, err := e.cached(ctx, "ptr:"+addr, func() (interface{}, error) {
+		names, err := e.resolver.LookupAddr(ctx, addr)
+		if names == nil {
+			names = []string{}
+		}
+		return names, err
+	})
+	return v.([]string), err
+}
+
+// returns the cached answer for key until it expires, or fetches and caches it unless ctx was done before it finished
+func (e *spfEvaluator) cached(ctx context.Context, key string, fetch func() (interface{}, error)) (interface{}, error) {
+	key = strings.ToLower(key)
+	e.mu.Lock()
+	answer, ok := e.cache[key]
+	e.mu.Unlock()
+	if ok && time.Now().Before(answer.expires) {
+		return answer.val, answer.err
+	}
+
+	val, err := fetch()
+	if ctx.Err() != nil {
+		return val, err
+	}
+	now := time.Now()
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	// drop what's expired now and then, so a long build doesn't keep every answer it ever saw
+	if now.Sub(e.swept) > e.ttl {
+		for k, a := range e.cache {
+			if !now.Before(a.expires) {
+				delete(e.cache, k)
+			}
+		}
+		e.swept = now
+	}
+	e.cache[key] = spfAnswer{val, err, now.Add(e.ttl)}
+	return val, err
+}
+
+// reports whether err is a DNS "no such host", which SPF treats as an empty answer
+func isNotFound(err error) bool {
+	if dnsErr, ok := err.(*net.DNSError); ok {
+		return dnsErr.IsNotFound
+	}
+	return false
+}
+
+// parses the argument of an ip4 or ip6 mechanism, which may omit the prefix length
+func parseSPFNetwork(arg string, v4 bool) (*net.IPNet, error) {
+	if !strings.Contains(arg, "/") {
+		if v4 {
+			arg += "/32"
+		} else {
+			arg += "/128"
+		}
+	}
+	_, network, err := net.ParseCIDR(arg)
+	return network, err
+}
+
+// parses an a or mx mechanism argument of the form [:domain][/cidr4][//cidr6]
+func parseSPFDualCIDR(arg, domain string) (string, int, int, error) {
+	var (
+		target = domain
+		v4, v6 = 32, 128
+		err    error
+	)
+
+	if idx := strings.Index(arg, "//"); idx != -1 {
+		if v6, err = strconv.Atoi(arg[idx+2:]); err != nil || v6 > 128 {
+			return "", 0, 0, fmt.Errorf("invalid ip6 cidr length in %q", arg)
+		}
+		arg = arg[:idx]
+	}
+	if idx := strings.Index(arg, "/"); idx != -1 {
+		if v4, err = strconv.Atoi(arg[idx+1:]); err != nil || v4 > 32 {
+			return "", 0, 0, fmt.Errorf("invalid ip4 cidr length in %q", arg)
+		}
+		arg = arg[:idx]
+	}
+	if strings.HasPrefix(arg, ":") {
+		target = arg[1:]
+	}
+	return target, v4, v6, nil
+}
+
+// reports whether ip and addr share the same network for their address family's prefix length
+func spfCIDRMatch(ip, addr net.IP, v4, v6 int) bool {
+	if ip4, addr4 := ip.To4(), addr.To4(); ip4 != nil && addr4 != nil {
+		mask := net.CIDRMask(v4, 32)
+		return ip4.Mask(mask).Equal(addr4.Mask(mask))
+	} else if ip4 == nil && addr4 == nil {
+		mask := net.CIDRMask(v6, 128)
+		return ip.Mask(mask).Equal(addr.Mask(mask))
+	}
+	return false
+}
+
+// expands the macros of RFC 7208 section 7 which can be known without the original message
+func expandSPFMacros(s string, ip net.IP, domain string) string {
+	if !strings.Contains(s, "%") {
+		return s
+	}
+
+	var out strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '%' || i+1 >= len(s) {
+			out.WriteByte(s[i])
+			continue
+		}
+
+		i++
+		switch s[i] {
+		case '%':
+			out.WriteByte('%')
+		case '_':
+			out.WriteByte(' ')
+		case '-':
+			out.WriteString("%20")
+		case '{':
+			end := strings.IndexByte(s[i:], '}')
+			if end == -1 {
+				out.WriteString(s[i-1:])
+				return out.String()
+			}
+			out.WriteString(expandSPFMacro(s[i+1:i+end], ip, domain))
+			i += end
+		default:
+			out.WriteByte('%')
+			out.WriteByte(s[i])
+		}
+	}
+	return out.String()
+}
+
+// expands a single macro body, i.e. "ir" from "%{ir}"
+func expandSPFMacro(macro string, ip net.IP, domain string) string {
+	if macro == "" {
+		return ""
+	}
+
+	var val string
+	switch macro[0] {
+	case 's', 'S':
+		val = "postmaster@" + domain
+	case 'l', 'L':
+		val = "postmaster"
+	case 'o', 'O', 'd', 'D', 'h', 'H':
+		val = domain
+	case 'i', 'I':
+		if ip4 := ip.To4(); ip4 != nil {
+			val = ip4.String()
+		} else {
+			nibbles := make([]string, 0, 32)
+			for _, b := range ip.To16() {
+				nibbles = append(nibbles, fmt.Sprintf("%x.%x", b>>4, b&0x0f))
+			}
+			val = strings.Join(nibbles, ".")
+		}
+	case 'v', 'V':
+		val = "ip6"
+		if ip.To4() != nil {
+			val = "in-addr"
+		}
+	default:
+		val = "unknown"
+	}
+
+	// transformers: an optional count of labels to keep, "r" to reverse, then delimiters
+	var (
+		rest    = macro[1:]
+		digits  = strings.IndexFunc(rest, func(r rune) bool { return r < '0' || r > '9' })
+		keep    int
+		reverse bool
+	)
+	if digits == -1 {
+		digits = len(rest)
+	}
+	keep, _ = strconv.Atoi(rest[:digits])
+	rest = rest[digits:]
+	if strings.HasPrefix(strings.ToLower(rest), "r") {
+		reverse, rest = true, rest[1:]
+	}
+	if rest == "" {
+		rest = "."
+	}
+
+	parts := strings.FieldsFunc(val, func(r rune) bool { return strings.ContainsRune(rest, r) })
+	if reverse {
+		for i, j := 0, len(parts)-1; i < j; i, j = i+1, j-1 {
+			parts[i], parts[j] = parts[j], parts[i]
+		}
+	}
+	if keep > 0 && keep < len(parts) {
+		parts = parts[len(parts)-keep:]
+	}
+	return strings.Join(parts, ".")
+}
+
+func joinSPFChain(term, chain string) string {
+	if chain == "" {
+		return term
+	}
+	return term + " > " + chain
+}
+
+// spfEnricher explains a failing SPF result by evaluating the source against the policy domain's SPF record today
+type spfEnricher struct{}
+
+func (spfEnricher) Name() string { return "spf" }
+
+func (spfEnricher) Network() bool { return true }
+
+func (spfEnricher) Enrich(ctx context.Context, report *DMARCFeedback, record DMARCRecord, attrs Attributes) (Attributes, error) {
+	ip := net.ParseIP(record.SourceIP)
+	if record.SPFResult == "pass" || ip == nil {
+		return nil, nil
+	}
+
+	eval := spfChecker.evaluate(ctx, ip, report.Policy.Domain)
+	return Attributes{
+		"spf_eval":      eval.Result,
+		"spf_mechanism": eval.Mechanism,
+		"spf_lookups":   strconv.Itoa(eval.Lookups),
+	}, ctx.Err()
+}
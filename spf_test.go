@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// answers SPF's DNS lookups from maps, with anything missing not found
+type stubResolver struct {
+	mu    sync.Mutex
+	txt   map[string][]string
+	ip    map[string][]string
+	mx    map[string][]string
+	ptr   map[string][]string
+	calls int
+}
+
+func (r *stubResolver) answer(m map[string][]string, name string) ([]string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.calls++
+	if v, ok := m[strings.ToLower(strings.TrimSuffix(name, "."))]; ok {
+		return v, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+func (r *stubResolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	return r.answer(r.txt, name)
+}
+
+func (r *stubResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	ips, err := r.answer(r.ip, host)
+	addrs := make([]net.IPAddr, len(ips))
+	for i, ip := range ips {
+		addrs[i] = net.IPAddr{IP: net.ParseIP(ip)}
+	}
+	return addrs, err
+}
+
+func (r *stubResolver) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	hosts, err := r.answer(r.mx, name)
+	mxs := make([]*net.MX, len(hosts))
+	for i, host := range hosts {
+		mxs[i] = &net.MX{Host: host, Pref: 10}
+	}
+	return mxs, err
+}
+
+func (r *stubResolver) LookupAddr(ctx context.Context, addr string) ([]string, error) {
+	return r.answer(r.ptr, addr)
+}
+
+func TestSPFEvaluate(t *testing.T) {
+	var (
+		tooMany = []string{"v=spf1"}
+		tooVoid = "v=spf1 a:void1.example.com a:void2.example.com a:void3.example.com -all"
+		ips     = map[string][]string{
+			"example.com":                        {"192.0.2.1"},
+			"mx1.example.com":                    {"192.0.2.25"},
+			"mail.example.com":                   {"198.51.100.7"},
+			"4.2.0.192.in-addr._spf.example.com": {"127.0.0.2"},
+		}
+	)
+	for i := 1; i <= 11; i++ {
+		host := fmt.Sprintf("h%d.example.com", i)
+		tooMany = append(tooMany, "a:"+host)
+		ips[host] = []string{"203.0.113.1"}
+	}
+
+	resolver := &stubResolver{
+		txt: map[string][]string{
+			"include.example.com":  {"v=spf1 include:_spf.example.net -all"},
+			"_spf.example.net":     {"v=spf1 ip4:192.0.2.0/24 ~all"},
+			"redirect.example.com": {"v=spf1 redirect=_spf.example.org"},
+			"_spf.example.org":     {"v=spf1 mx ?all"},
+			"exists.example.com":   {"v=spf1 exists:%{ir}.%{v}._spf.example.com -all"},
+			"toomany.example.com":  {strings.Join(append(tooMany, "-all"), " ")},
+			"void.example.com":     {tooVoid},
+			"twovoid.example.com":  {"v=spf1 a:void1.example.com mx:void2.example.com -all"},
+			"ptr.example.com":      {"v=spf1 ptr:example.com -all"},
+			"multiple.example.com": {"v=spf1 -all", "v=spf1 +all"},
+		},
+		ip: ips,
+		mx: map[string][]string{
+			"_spf.example.org": {"mx1.example.com"},
+		},
+		ptr: map[string][]string{
+			"198.51.100.7": {"mail.example.com."},
+		},
+	}
+	eval := newSPFEvaluator(resolver, time.Hour)
+
+	tests := []struct {
+		name      string
+		domain    string
+		ip        string
+		result    string
+		mechanism string
+		lookups   int
+	}{
+		{"include pass", "include.example.com", "192.0.2.10", "pass", "include:_spf.example.net > ip4:192.0.2.0/24", 1},
+		{"include fail", "include.example.com", "203.0.113.9", "fail", "all", 1},
+		{"redirect pass", "redirect.example.com", "192.0.2.25", "pass", "redirect=_spf.example.org > mx", 2},
+		{"redirect neutral", "redirect.example.com", "203.0.113.9", "neutral", "redirect=_spf.example.org > all", 2},
+		{"exists macro", "exists.example.com", "192.0.2.4", "pass", "exists:%{ir}.%{v}._spf.example.com", 1},
+		{"exists missing", "exists.example.com", "192.0.2.5", "fail", "all", 1},
+		{"lookup limit", "toomany.example.com", "192.0.2.10", "permerror", "a:h11.example.com", 11},
+		{"void limit", "void.example.com", "192.0.2.10", "permerror", "a:void3.example.com", 3},
+		{"two voids", "twovoid.example.com", "192.0.2.10", "fail", "all", 2},
+		{"validated ptr", "ptr.example.com", "198.51.100.7", "pass", "ptr:example.com", 1},
+		{"no record", "none.example.com", "192.0.2.10", "none", "", 0},
+		{"multiple records", "multiple.example.com", "192.0.2.10", "permerror", "", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := eval.evaluate(context.Background(), net.ParseIP(tt.ip), tt.domain)
+			if got.Result != tt.result || got.Mechanism != tt.mechanism || got.Lookups != tt.lookups {
+				t.Errorf("evaluate(%s, %s) = %+v, want {%s %s %d}", tt.ip, tt.domain, got, tt.result, tt.mechanism, tt.lookups)
+			}
+		})
+	}
+}
+
+func TestSPFCountLookupsStops(t *testing.T) {
+	// every include in the tree includes twelve more, which would take thousands of queries to walk
+	resolver := &stubResolver{txt: map[string][]string{}}
+	for _, name := range []string{"wide.example.com", "i1.example.com", "i2.example.com"} {
+		terms := []string{"v=spf1"}
+		for i := 1; i <= 12; i++ {
+			terms = append(terms, fmt.Sprintf("include:i%d.example.com", i))
+		}
+		resolver.txt[name] = []string{strings.Join(terms, " ")}
+	}
+	for i := 3; i <= 12; i++ {
+		resolver.txt[fmt.Sprintf("i%d.example.com", i)] = resolver.txt["wide.example.com"]
+	}
+	eval := newSPFEvaluator(resolver, time.Hour)
+
+	if got := eval.countLookups(context.Background(), "wide.example.com", 0, 0); got != spfLookupLimit+1 {
+		t.Errorf("countLookups = %d, want %d", got, spfLookupLimit+1)
+	}
+	if resolver.calls > 2*spfLookupLimit {
+		t.Errorf("countLookups made %d queries, want it to stop past the limit", resolver.calls)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if got := newSPFEvaluator(resolver, time.Hour).countLookups(ctx, "wide.example.com", 0, 0); got > 1 {
+		t.Errorf("countLookups with ctx done = %d, want it to stop at once", got)
+	}
+}
+
+func TestExpandSPFMacros(t *testing.T) {
+	tests := []struct {
+		in, ip, domain, want string
+	}{
+		{"%{ir}.%{v}._spf.%{d}", "192.0.2.3", "example.com", "3.2.0.192.in-addr._spf.example.com"},
+		{"%{d2}", "192.0.2.3", "mail.sub.example.com", "example.com"},
+		{"%{dr}", "192.0.2.3", "mail.example.com", "com.example.mail"},
+		{"%{l}.%{o}", "192.0.2.3", "example.com", "postmaster.example.com"},
+		{"%{i}", "2001:db8::1", "example.com", "2.0.0.1.0.d.b.8.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.1"},
+		{"a%%b%_c%-d", "192.0.2.3", "example.com", "a%b c%20d"},
+		{"no.macros", "192.0.2.3", "example.com", "no.macros"},
+	}
+	for _, tt := range tests {
+		if got := expandSPFMacros(tt.in, net.ParseIP(tt.ip), tt.domain); got != tt.want {
+			t.Errorf("expandSPFMacros(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestSPFCacheExpires(t *testing.T) {
+	resolver := &stubResolver{txt: map[string][]string{"example.com": {"v=spf1 -all"}}}
+	eval := newSPFEvaluator(resolver, 50*time.Millisecond)
+	ip := net.ParseIP("192.0.2.1")
+
+	eval.evaluate(context.Background(), ip, "example.com")
+	calls := resolver.calls
+	resolver.txt["example.com"] = []string{"v=spf1 +all"}
+	if got := eval.evaluate(context.Background(), ip, "example.com"); got.Result != "fail" || resolver.calls != calls {
+		t.Errorf("before expiring got %s after %d lookups, want the cached fail", got.Result, resolver.calls-calls)
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	if got := eval.evaluate(context.Background(), ip, "example.com"); got.Result != "pass" {
+		t.Errorf("after expiring got %s, want the republished pass", got.Result)
+	}
+}
@@ -26,4 +26,86 @@ dkim_hresult text,
 spf_domain text,
 spf_result text,
 hostname text,
-PRIMARY KEY (id))
\ No newline at end of file
+dnsbl varchar(255),
+asn bigint,
+sender varchar(255),
+spf_eval varchar(16),
+spf_mechanism varchar(max),
+spf_lookups int,
+policy_drift varchar(255),
+geo_build bigint,
+record_key varchar(40),
+enrich_pending bit NOT NULL DEFAULT 0,
+report_id varchar(255),
+raw_report varchar(64),
+dkim_alignment varchar(16),
+spf_alignment varchar(16),
+org_domain varchar(255),
+PRIMARY KEY (id))
+
+CREATE INDEX records_record_key_idx ON InfSec_DMARC.dbo.records (record_key)
+
+CREATE TABLE InfSec_DMARC.dbo.dns_snapshots
+(id bigint IDENTITY (1,1) NOT NULL,
+domain varchar(255) NOT NULL,
+observed_at bigint NOT NULL,
+dmarc varchar(max),
+spf varchar(max),
+dkim varchar(max),
+p varchar(16),
+pct int,
+adkim varchar(1),
+aspf varchar(1),
+PRIMARY KEY (id))
+
+CREATE INDEX dns_snapshots_domain_observed_at_idx ON InfSec_DMARC.dbo.dns_snapshots (domain, observed_at)
+
+CREATE TABLE InfSec_DMARC.dbo.record_attributes
+(record_key varchar(40) NOT NULL,
+enricher varchar(64) NOT NULL,
+name varchar(64) NOT NULL,
+value varchar(max))
+
+CREATE INDEX record_attributes_record_key_idx ON InfSec_DMARC.dbo.record_attributes (record_key)
+
+CREATE INDEX records_report_id_idx ON InfSec_DMARC.dbo.records (report_id)
+
+CREATE TABLE InfSec_DMARC.dbo.raw_reports
+(sha256 varchar(64) NOT NULL,
+filename varchar(255),
+size bigint,
+archived_at bigint,
+PRIMARY KEY (sha256))
+
+CREATE TABLE InfSec_DMARC.dbo.sender_first_seen
+(domain varchar(255) NOT NULL,
+network varchar(64) NOT NULL,
+asn bigint,
+source_ip varchar(64),
+first_seen bigint NOT NULL,
+detected_at bigint NOT NULL,
+record_key varchar(64),
+PRIMARY KEY (domain, network))
+
+CREATE INDEX sender_first_seen_first_seen_idx ON InfSec_DMARC.dbo.sender_first_seen (first_seen)
+
+CREATE INDEX records_asn_idx ON InfSec_DMARC.dbo.records (asn)
+
+CREATE TABLE InfSec_DMARC.dbo.daily_rollup
+(day bigint NOT NULL,
+domain varchar(255),
+source_ip varchar(64),
+asn bigint,
+sender varchar(255),
+hostname varchar(max),
+location varchar(255),
+dkim varchar(16),
+spf varchar(16),
+disposition varchar(16),
+messages float NOT NULL)
+
+CREATE INDEX daily_rollup_day_domain_idx ON InfSec_DMARC.dbo.daily_rollup (day, domain)
+
+CREATE INDEX records_date_range_begin_idx ON InfSec_DMARC.dbo.records (date_range_begin)
+
+CREATE INDEX records_org_domain_idx ON InfSec_DMARC.dbo.records (org_domain)
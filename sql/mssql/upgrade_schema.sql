@@ -0,0 +1,93 @@
+-- Upgrades a database created from an earlier create_schema.sql to the current one, adding the columns,
+-- tables and indexes dmarcdb has needed since. Safe to run more than once, anything already there is skipped.
+-- Run it before the first `dmarcdb build` after upgrading, which otherwise fails storing the new columns.
+
+IF COL_LENGTH('InfSec_DMARC.dbo.records', 'dnsbl') IS NULL ALTER TABLE InfSec_DMARC.dbo.records ADD dnsbl varchar(255)
+IF COL_LENGTH('InfSec_DMARC.dbo.records', 'asn') IS NULL ALTER TABLE InfSec_DMARC.dbo.records ADD asn bigint
+IF COL_LENGTH('InfSec_DMARC.dbo.records', 'sender') IS NULL ALTER TABLE InfSec_DMARC.dbo.records ADD sender varchar(255)
+IF COL_LENGTH('InfSec_DMARC.dbo.records', 'spf_eval') IS NULL ALTER TABLE InfSec_DMARC.dbo.records ADD spf_eval varchar(16)
+IF COL_LENGTH('InfSec_DMARC.dbo.records', 'spf_mechanism') IS NULL ALTER TABLE InfSec_DMARC.dbo.records ADD spf_mechanism varchar(max)
+IF COL_LENGTH('InfSec_DMARC.dbo.records', 'spf_lookups') IS NULL ALTER TABLE InfSec_DMARC.dbo.records ADD spf_lookups int
+IF COL_LENGTH('InfSec_DMARC.dbo.records', 'policy_drift') IS NULL ALTER TABLE InfSec_DMARC.dbo.records ADD policy_drift varchar(255)
+IF COL_LENGTH('InfSec_DMARC.dbo.records', 'geo_build') IS NULL ALTER TABLE InfSec_DMARC.dbo.records ADD geo_build bigint
+IF COL_LENGTH('InfSec_DMARC.dbo.records', 'record_key') IS NULL ALTER TABLE InfSec_DMARC.dbo.records ADD record_key varchar(40)
+IF COL_LENGTH('InfSec_DMARC.dbo.records', 'enrich_pending') IS NULL ALTER TABLE InfSec_DMARC.dbo.records ADD enrich_pending bit NOT NULL DEFAULT 0
+IF COL_LENGTH('InfSec_DMARC.dbo.records', 'report_id') IS NULL ALTER TABLE InfSec_DMARC.dbo.records ADD report_id varchar(255)
+IF COL_LENGTH('InfSec_DMARC.dbo.records', 'raw_report') IS NULL ALTER TABLE InfSec_DMARC.dbo.records ADD raw_report varchar(64)
+IF COL_LENGTH('InfSec_DMARC.dbo.records', 'dkim_alignment') IS NULL ALTER TABLE InfSec_DMARC.dbo.records ADD dkim_alignment varchar(16)
+IF COL_LENGTH('InfSec_DMARC.dbo.records', 'spf_alignment') IS NULL ALTER TABLE InfSec_DMARC.dbo.records ADD spf_alignment varchar(16)
+IF COL_LENGTH('InfSec_DMARC.dbo.records', 'org_domain') IS NULL ALTER TABLE InfSec_DMARC.dbo.records ADD org_domain varchar(255)
+
+GO
+
+IF NOT EXISTS (SELECT 1 FROM InfSec_DMARC.sys.indexes WHERE name = 'records_record_key_idx') CREATE INDEX records_record_key_idx ON InfSec_DMARC.dbo.records (record_key)
+
+IF NOT EXISTS (SELECT 1 FROM InfSec_DMARC.sys.indexes WHERE name = 'records_report_id_idx') CREATE INDEX records_report_id_idx ON InfSec_DMARC.dbo.records (report_id)
+
+IF NOT EXISTS (SELECT 1 FROM InfSec_DMARC.sys.indexes WHERE name = 'records_asn_idx') CREATE INDEX records_asn_idx ON InfSec_DMARC.dbo.records (asn)
+
+IF NOT EXISTS (SELECT 1 FROM InfSec_DMARC.sys.indexes WHERE name = 'records_date_range_begin_idx') CREATE INDEX records_date_range_begin_idx ON InfSec_DMARC.dbo.records (date_range_begin)
+
+IF NOT EXISTS (SELECT 1 FROM InfSec_DMARC.sys.indexes WHERE name = 'records_org_domain_idx') CREATE INDEX records_org_domain_idx ON InfSec_DMARC.dbo.records (org_domain)
+
+IF OBJECT_ID('InfSec_DMARC.dbo.dns_snapshots') IS NULL
+CREATE TABLE InfSec_DMARC.dbo.dns_snapshots
+(id bigint IDENTITY (1,1) NOT NULL,
+domain varchar(255) NOT NULL,
+observed_at bigint NOT NULL,
+dmarc varchar(max),
+spf varchar(max),
+dkim varchar(max),
+p varchar(16),
+pct int,
+adkim varchar(1),
+aspf varchar(1),
+PRIMARY KEY (id))
+
+IF NOT EXISTS (SELECT 1 FROM InfSec_DMARC.sys.indexes WHERE name = 'dns_snapshots_domain_observed_at_idx') CREATE INDEX dns_snapshots_domain_observed_at_idx ON InfSec_DMARC.dbo.dns_snapshots (domain, observed_at)
+
+IF OBJECT_ID('InfSec_DMARC.dbo.record_attributes') IS NULL
+CREATE TABLE InfSec_DMARC.dbo.record_attributes
+(record_key varchar(40) NOT NULL,
+enricher varchar(64) NOT NULL,
+name varchar(64) NOT NULL,
+value varchar(max))
+
+IF NOT EXISTS (SELECT 1 FROM InfSec_DMARC.sys.indexes WHERE name = 'record_attributes_record_key_idx') CREATE INDEX record_attributes_record_key_idx ON InfSec_DMARC.dbo.record_attributes (record_key)
+
+IF OBJECT_ID('InfSec_DMARC.dbo.raw_reports') IS NULL
+CREATE TABLE InfSec_DMARC.dbo.raw_reports
+(sha256 varchar(64) NOT NULL,
+filename varchar(255),
+size bigint,
+archived_at bigint,
+PRIMARY KEY (sha256))
+
+IF OBJECT_ID('InfSec_DMARC.dbo.sender_first_seen') IS NULL
+CREATE TABLE InfSec_DMARC.dbo.sender_first_seen
+(domain varchar(255) NOT NULL,
+network varchar(64) NOT NULL,
+asn bigint,
+source_ip varchar(64),
+first_seen bigint NOT NULL,
+detected_at bigint NOT NULL,
+record_key varchar(64),
+PRIMARY KEY (domain, network))
+
+IF NOT EXISTS (SELECT 1 FROM InfSec_DMARC.sys.indexes WHERE name = 'sender_first_seen_first_seen_idx') CREATE INDEX sender_first_seen_first_seen_idx ON InfSec_DMARC.dbo.sender_first_seen (first_seen)
+
+IF OBJECT_ID('InfSec_DMARC.dbo.daily_rollup') IS NULL
+CREATE TABLE InfSec_DMARC.dbo.daily_rollup
+(day bigint NOT NULL,
+domain varchar(255),
+source_ip varchar(64),
+asn bigint,
+sender varchar(255),
+hostname varchar(max),
+location varchar(255),
+dkim varchar(16),
+spf varchar(16),
+disposition varchar(16),
+messages float NOT NULL)
+
+IF NOT EXISTS (SELECT 1 FROM InfSec_DMARC.sys.indexes WHERE name = 'daily_rollup_day_domain_idx') CREATE INDEX daily_rollup_day_domain_idx ON InfSec_DMARC.dbo.daily_rollup (day, domain)
@@ -65,7 +65,22 @@ CREATE TABLE records (
     dkim_hresult text,
     spf_domain text,
     spf_result text,
-    hostname text
+    hostname text,
+    dnsbl text,
+    asn bigint,
+    sender text,
+    spf_eval text,
+    spf_mechanism text,
+    spf_lookups integer,
+    policy_drift text,
+    geo_build bigint,
+    record_key text,
+    enrich_pending boolean DEFAULT false NOT NULL,
+    report_id text,
+    raw_report text,
+    dkim_alignment text,
+    spf_alignment text,
+    org_domain text
 );
 
 
@@ -107,6 +122,126 @@ ALTER TABLE ONLY records
     ADD CONSTRAINT records_pkey PRIMARY KEY (id);
 
 
+--
+-- Name: dns_snapshots; Type: TABLE; Schema: public; Owner: postgres
+--
+
+CREATE TABLE dns_snapshots (
+    id bigserial PRIMARY KEY,
+    domain text NOT NULL,
+    observed_at bigint NOT NULL,
+    dmarc text,
+    spf text,
+    dkim text,
+    p text,
+    pct integer,
+    adkim text,
+    aspf text
+);
+
+
+ALTER TABLE dns_snapshots OWNER TO postgres;
+
+CREATE INDEX dns_snapshots_domain_observed_at_idx ON dns_snapshots USING btree (domain, observed_at);
+
+
+--
+-- Name: record_attributes; Type: TABLE; Schema: public; Owner: postgres
+--
+
+CREATE TABLE record_attributes (
+    record_key text NOT NULL,
+    enricher text NOT NULL,
+    name text NOT NULL,
+    value text
+);
+
+
+ALTER TABLE record_attributes OWNER TO postgres;
+
+CREATE INDEX record_attributes_record_key_idx ON record_attributes USING btree (record_key);
+
+CREATE INDEX records_record_key_idx ON records USING btree (record_key);
+
+CREATE INDEX records_enrich_pending_idx ON records USING btree (id) WHERE enrich_pending;
+
+
+CREATE INDEX records_report_id_idx ON records USING btree (report_id);
+
+
+--
+-- Name: raw_reports; Type: TABLE; Schema: public; Owner: postgres
+--
+
+CREATE TABLE raw_reports (
+    sha256 text NOT NULL,
+    filename text,
+    size bigint,
+    archived_at bigint
+);
+
+
+ALTER TABLE raw_reports OWNER TO postgres;
+
+ALTER TABLE ONLY raw_reports
+    ADD CONSTRAINT raw_reports_pkey PRIMARY KEY (sha256);
+
+
+--
+-- Name: sender_first_seen; Type: TABLE; Schema: public; Owner: postgres
+--
+
+CREATE TABLE sender_first_seen (
+    domain text NOT NULL,
+    network text NOT NULL,
+    asn bigint,
+    source_ip text,
+    first_seen bigint NOT NULL,
+    detected_at bigint NOT NULL,
+    record_key text
+);
+
+
+ALTER TABLE sender_first_seen OWNER TO postgres;
+
+ALTER TABLE ONLY sender_first_seen
+    ADD CONSTRAINT sender_first_seen_pkey PRIMARY KEY (domain, network);
+
+CREATE INDEX sender_first_seen_first_seen_idx ON sender_first_seen USING btree (first_seen);
+
+CREATE INDEX records_asn_idx ON records USING btree (asn);
+
+
+--
+-- Name: daily_rollup; Type: TABLE; Schema: public; Owner: postgres
+--
+
+CREATE TABLE daily_rollup (
+    day bigint NOT NULL,
+    domain text,
+    source_ip text,
+    asn bigint,
+    sender text,
+    hostname text,
+    location text,
+    dkim text,
+    spf text,
+    disposition text,
+    messages double precision NOT NULL
+);
+
+
+ALTER TABLE daily_rollup OWNER TO postgres;
+
+CREATE INDEX daily_rollup_day_domain_idx ON daily_rollup USING btree (day, domain);
+
+
+CREATE INDEX records_date_range_begin_idx ON records USING btree (date_range_begin);
+
+
+CREATE INDEX records_org_domain_idx ON records USING btree (org_domain);
+
+
 --
 -- PostgreSQL database dump complete
 --
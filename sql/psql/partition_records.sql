@@ -0,0 +1,57 @@
+--
+-- Converts records into a table partitioned by month of date_range_begin (PostgreSQL 11 or later), so
+-- `dmarcdb prune` can drop a whole month at once. Existing records are moved into a partition for each month
+-- they began in, those without a date_range_begin into the default partition (which prune deletes from in
+-- batches), and prune creates each month's partition ahead of time from then on.
+-- Stop dmarcdb (and its scheduled tasks) while this runs, it rewrites every record in one transaction.
+--
+
+BEGIN;
+
+ALTER TABLE records RENAME TO records_unpartitioned;
+
+CREATE TABLE records (LIKE records_unpartitioned INCLUDING DEFAULTS) PARTITION BY RANGE (date_range_begin);
+
+ALTER TABLE records OWNER TO postgres;
+
+CREATE TABLE records_default PARTITION OF records DEFAULT;
+
+-- a partition for each (UTC) month the existing records began in, named like records_2018_01
+DO $$
+DECLARE
+    month timestamp;
+BEGIN
+    FOR month IN SELECT DISTINCT date_trunc('month', to_timestamp(date_range_begin) AT TIME ZONE 'UTC')
+            FROM records_unpartitioned WHERE date_range_begin IS NOT NULL LOOP
+        EXECUTE format('CREATE TABLE %I PARTITION OF records FOR VALUES FROM (%s) TO (%s)',
+            'records_' || to_char(month, 'YYYY_MM'),
+            extract(epoch FROM month AT TIME ZONE 'UTC')::bigint,
+            extract(epoch FROM (month + interval '1 month') AT TIME ZONE 'UTC')::bigint);
+    END LOOP;
+END
+$$;
+
+INSERT INTO records SELECT * FROM records_unpartitioned;
+
+-- the id sequence would otherwise be dropped with the old table
+ALTER SEQUENCE records_id_seq OWNED BY records.id;
+
+DROP TABLE records_unpartitioned;
+
+-- a partitioned table's primary key has to include its partition key
+ALTER TABLE ONLY records
+    ADD CONSTRAINT records_pkey PRIMARY KEY (id, date_range_begin);
+
+CREATE INDEX records_record_key_idx ON records USING btree (record_key);
+
+CREATE INDEX records_enrich_pending_idx ON records USING btree (id) WHERE enrich_pending;
+
+CREATE INDEX records_report_id_idx ON records USING btree (report_id);
+
+CREATE INDEX records_asn_idx ON records USING btree (asn);
+
+CREATE INDEX records_date_range_begin_idx ON records USING btree (date_range_begin);
+
+CREATE INDEX records_org_domain_idx ON records USING btree (org_domain);
+
+COMMIT;
@@ -0,0 +1,114 @@
+--
+-- Upgrades a database created from an earlier dmarcdb_schema.sql to the current one, adding the columns,
+-- tables and indexes dmarcdb has needed since. Safe to run more than once, anything already there is skipped.
+-- Run it before the first `dmarcdb build` after upgrading, which otherwise fails storing the new columns.
+--
+
+BEGIN;
+
+ALTER TABLE records
+    ADD COLUMN IF NOT EXISTS dnsbl text,
+    ADD COLUMN IF NOT EXISTS asn bigint,
+    ADD COLUMN IF NOT EXISTS sender text,
+    ADD COLUMN IF NOT EXISTS spf_eval text,
+    ADD COLUMN IF NOT EXISTS spf_mechanism text,
+    ADD COLUMN IF NOT EXISTS spf_lookups integer,
+    ADD COLUMN IF NOT EXISTS policy_drift text,
+    ADD COLUMN IF NOT EXISTS geo_build bigint,
+    ADD COLUMN IF NOT EXISTS record_key text,
+    ADD COLUMN IF NOT EXISTS enrich_pending boolean DEFAULT false NOT NULL,
+    ADD COLUMN IF NOT EXISTS report_id text,
+    ADD COLUMN IF NOT EXISTS raw_report text,
+    ADD COLUMN IF NOT EXISTS dkim_alignment text,
+    ADD COLUMN IF NOT EXISTS spf_alignment text,
+    ADD COLUMN IF NOT EXISTS org_domain text;
+
+CREATE INDEX IF NOT EXISTS records_record_key_idx ON records USING btree (record_key);
+
+CREATE INDEX IF NOT EXISTS records_enrich_pending_idx ON records USING btree (id) WHERE enrich_pending;
+
+CREATE INDEX IF NOT EXISTS records_report_id_idx ON records USING btree (report_id);
+
+CREATE INDEX IF NOT EXISTS records_asn_idx ON records USING btree (asn);
+
+CREATE INDEX IF NOT EXISTS records_date_range_begin_idx ON records USING btree (date_range_begin);
+
+CREATE INDEX IF NOT EXISTS records_org_domain_idx ON records USING btree (org_domain);
+
+
+CREATE TABLE IF NOT EXISTS dns_snapshots (
+    id bigserial PRIMARY KEY,
+    domain text NOT NULL,
+    observed_at bigint NOT NULL,
+    dmarc text,
+    spf text,
+    dkim text,
+    p text,
+    pct integer,
+    adkim text,
+    aspf text
+);
+
+ALTER TABLE dns_snapshots OWNER TO postgres;
+
+CREATE INDEX IF NOT EXISTS dns_snapshots_domain_observed_at_idx ON dns_snapshots USING btree (domain, observed_at);
+
+
+CREATE TABLE IF NOT EXISTS record_attributes (
+    record_key text NOT NULL,
+    enricher text NOT NULL,
+    name text NOT NULL,
+    value text
+);
+
+ALTER TABLE record_attributes OWNER TO postgres;
+
+CREATE INDEX IF NOT EXISTS record_attributes_record_key_idx ON record_attributes USING btree (record_key);
+
+
+CREATE TABLE IF NOT EXISTS raw_reports (
+    sha256 text NOT NULL,
+    filename text,
+    size bigint,
+    archived_at bigint,
+    CONSTRAINT raw_reports_pkey PRIMARY KEY (sha256)
+);
+
+ALTER TABLE raw_reports OWNER TO postgres;
+
+
+CREATE TABLE IF NOT EXISTS sender_first_seen (
+    domain text NOT NULL,
+    network text NOT NULL,
+    asn bigint,
+    source_ip text,
+    first_seen bigint NOT NULL,
+    detected_at bigint NOT NULL,
+    record_key text,
+    CONSTRAINT sender_first_seen_pkey PRIMARY KEY (domain, network)
+);
+
+ALTER TABLE sender_first_seen OWNER TO postgres;
+
+CREATE INDEX IF NOT EXISTS sender_first_seen_first_seen_idx ON sender_first_seen USING btree (first_seen);
+
+
+CREATE TABLE IF NOT EXISTS daily_rollup (
+    day bigint NOT NULL,
+    domain text,
+    source_ip text,
+    asn bigint,
+    sender text,
+    hostname text,
+    location text,
+    dkim text,
+    spf text,
+    disposition text,
+    messages double precision NOT NULL
+);
+
+ALTER TABLE daily_rollup OWNER TO postgres;
+
+CREATE INDEX IF NOT EXISTS daily_rollup_day_domain_idx ON daily_rollup USING btree (day, domain);
+
+COMMIT;
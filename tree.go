@@ -0,0 +1,189 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+)
+
+// a header_from domain in the tree of its organizational domain, with its own mail and that of its subdomains
+type domainNode struct {
+	Name     string `json:"domain"`
+	Messages int64  `json:"messages"`
+	Passing  int64  `json:"passing"`
+	// including every subdomain beneath it
+	TotalMessages int64 `json:"total_messages"`
+	TotalPassing  int64 `json:"total_passing"`
+	// the domains whose policy its mail was evaluated under when it wasn't its own, i.e. the organizational domain
+	InheritedFrom []string      `json:"inherited_policy_from,omitempty"`
+	Children      []*domainNode `json:"subdomains,omitempty"`
+	inherited     map[string]bool
+}
+
+// whether the domain sends mail without publishing a policy of its own
+func (n *domainNode) noPolicy() bool {
+	return n.Messages > 0 && len(n.InheritedFrom) > 0
+}
+
+// handles `dmarcdb tree [--since 30d] [--domain wvu.edu] [--json]`, printing each organizational domain's mail
+// rolled up from its subdomains, and highlighting subdomains sending without their own policy
+func tree(args ...string) error {
+	var (
+		flags  = flag.NewFlagSet("tree", flag.ContinueOnError)
+		since  = flags.String("since", "30d", "only records reported since, i.e. 30d or 2018-01-31 (\"\" for all)")
+		domain = flags.String("domain", "", "only this organizational domain")
+		asJSON = flags.Bool("json", false, "print the trees as JSON")
+	)
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	sinceTime, err := parseSince(*since)
+	if err != nil {
+		return err
+	}
+
+	roots, err := loadDomainTrees(sinceTime.Unix(), strings.ToLower(*domain))
+	if err != nil {
+		return err
+	}
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(roots)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "DOMAIN\tMESSAGES\tPASS RATE\tOWN MESSAGES\tOWN PASS RATE\tPOLICY")
+	var printNode func(n *domainNode, depth int)
+	printNode = func(n *domainNode, depth int) {
+		policy := "own"
+		switch {
+		case n.noPolicy():
+			policy = "NONE, inherits " + strings.Join(n.InheritedFrom, ", ")
+		case n.Messages == 0:
+			policy = ""
+		}
+		fmt.Fprintf(w, "%s%s\t%d\t%.1f%%\t%d\t%.1f%%\t%s\n", strings.Repeat("  ", depth), n.Name, n.TotalMessages, percent(n.TotalPassing, n.TotalMessages), n.Messages, percent(n.Passing, n.Messages), policy)
+		for _, c := range n.Children {
+			printNode(c, depth+1)
+		}
+	}
+	for _, root := range roots {
+		printNode(root, 0)
+	}
+	return w.Flush()
+}
+
+// builds a tree per organizational domain of the header_from domains reported since a time, each subdomain
+// under its closest reported parent domain
+func loadDomainTrees(since int64, org string) ([]*domainNode, error) {
+	var (
+		from   = fromDomainCol()
+		policy = "LOWER(" + textCol("domain") + ")"
+		conds  = "date_range_begin >= $1"
+		params = []interface{}{since}
+	)
+	if org != "" {
+		conds += " AND " + textCol("org_domain") + " = $2"
+		params = append(params, org)
+	}
+	query := fmt.Sprintf("SELECT %[1]s, %[2]s, SUM(count), SUM(CASE WHEN %[3]s THEN count ELSE 0 END) FROM records WHERE %[4]s GROUP BY %[1]s, %[2]s",
+		from, policy, evaluatedPass(), conds)
+	rows, err := db.Query(rebind(query), params...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	nodes := map[string]*domainNode{}
+	for rows.Next() {
+		var (
+			fromDom, policyDom sql.NullString
+			messages, passing  sql.NullInt64
+		)
+		if err = rows.Scan(&fromDom, &policyDom, &messages, &passing); err != nil {
+			return nil, err
+		}
+
+		name := strings.TrimSuffix(fromDom.String, ".")
+		if name == "" {
+			continue
+		}
+		n := nodes[name]
+		if n == nil {
+			n = &domainNode{Name: name, inherited: map[string]bool{}}
+			nodes[name] = n
+		}
+		n.Messages += messages.Int64
+		n.Passing += passing.Int64
+		// mail is evaluated under the header_from domain's own policy when it has one, so any other was inherited
+		policyName := strings.TrimSuffix(policyDom.String, ".")
+		if policyName != name && !n.inherited[policyName] {
+			n.inherited[policyName] = true
+			n.InheritedFrom = append(n.InheritedFrom, policyName)
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// organizational domains head their trees, whether or not they send mail themselves
+	for name := range nodes {
+		if o := orgDomain(name); nodes[o] == nil && (org == "" || o == org) {
+			nodes[o] = &domainNode{Name: o, inherited: map[string]bool{}}
+		}
+	}
+	names := make([]string, 0, len(nodes))
+	for name := range nodes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var roots []*domainNode
+	for _, name := range names {
+		n := nodes[name]
+		sort.Strings(n.InheritedFrom)
+		if parent := parentDomain(name, nodes); parent != nil {
+			parent.Children = append(parent.Children, n)
+		} else {
+			roots = append(roots, n)
+		}
+	}
+	for _, root := range roots {
+		rollUp(root)
+	}
+	sort.Slice(roots, func(i, j int) bool { return roots[i].TotalMessages > roots[j].TotalMessages })
+	return roots, nil
+}
+
+// finds a domain's closest parent among the nodes, stopping at its organizational domain
+func parentDomain(name string, nodes map[string]*domainNode) *domainNode {
+	org := orgDomain(name)
+	for name != org {
+		i := strings.Index(name, ".")
+		if i < 0 {
+			return nil
+		}
+		name = name[i+1:]
+		if n := nodes[name]; n != nil {
+			return n
+		}
+	}
+	return nil
+}
+
+// sums each node's mail with its subdomains', ordering the subdomains by volume
+func rollUp(n *domainNode) {
+	n.TotalMessages, n.TotalPassing = n.Messages, n.Passing
+	for _, c := range n.Children {
+		rollUp(c)
+		n.TotalMessages += c.TotalMessages
+		n.TotalPassing += c.TotalPassing
+	}
+	sort.Slice(n.Children, func(i, j int) bool { return n.Children[i].TotalMessages > n.Children[j].TotalMessages })
+}
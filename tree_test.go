@@ -0,0 +1,66 @@
+package main
+
+import "testing"
+
+func TestParentDomain(t *testing.T) {
+	nodes := map[string]*domainNode{}
+	for _, name := range []string{"wvu.edu", "mail.wvu.edu", "example.co.uk"} {
+		nodes[name] = &domainNode{Name: name}
+	}
+	tests := []struct {
+		name, parent string
+	}{
+		{"it.wvu.edu", "wvu.edu"},
+		{"a.b.mail.wvu.edu", "mail.wvu.edu"},
+		{"mail.wvu.edu", "wvu.edu"},
+		// organizational domains head their own trees
+		{"wvu.edu", ""},
+		// rather than going up to the public suffix
+		{"news.example.co.uk", "example.co.uk"},
+		{"example.co.uk", ""},
+		// nor into another organization's tree
+		{"mail.other.edu", ""},
+	}
+	for _, tt := range tests {
+		var got string
+		if n := parentDomain(tt.name, nodes); n != nil {
+			got = n.Name
+		}
+		if got != tt.parent {
+			t.Errorf("parentDomain(%s) = %q, want %q", tt.name, got, tt.parent)
+		}
+	}
+}
+
+func TestRollUp(t *testing.T) {
+	var (
+		it   = &domainNode{Name: "it.wvu.edu", Messages: 10, Passing: 10}
+		deep = &domainNode{Name: "a.mail.wvu.edu", Messages: 50, Passing: 5}
+		mail = &domainNode{Name: "mail.wvu.edu", Messages: 5, Passing: 5, Children: []*domainNode{deep}}
+		root = &domainNode{Name: "wvu.edu", Children: []*domainNode{it, mail}}
+	)
+	rollUp(root)
+
+	tests := []struct {
+		n                           *domainNode
+		totalMessages, totalPassing int64
+	}{
+		{root, 65, 20},
+		{mail, 55, 10},
+		{deep, 50, 5},
+		{it, 10, 10},
+	}
+	for _, tt := range tests {
+		if tt.n.TotalMessages != tt.totalMessages || tt.n.TotalPassing != tt.totalPassing {
+			t.Errorf("%s totals %d messages, %d passing, want %d, %d", tt.n.Name, tt.n.TotalMessages, tt.n.TotalPassing, tt.totalMessages, tt.totalPassing)
+		}
+	}
+	// subdomains by volume, including their own subdomains'
+	if root.Children[0] != mail || root.Children[1] != it {
+		t.Errorf("wvu.edu subdomains ordered %s, %s, want mail.wvu.edu first", root.Children[0].Name, root.Children[1].Name)
+	}
+	// own mail isn't counted twice
+	if root.Messages != 0 || mail.Messages != 5 {
+		t.Errorf("own messages changed to %d and %d", root.Messages, mail.Messages)
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"html/template"
@@ -11,23 +12,112 @@ import (
 	"github.com/spf13/viper"
 )
 
-// starts web server on configured port
-func startWeb(port string) error {
+// starts web server on configured port, serving until ctx is canceled and then draining open requests
+func startWeb(ctx context.Context, port string) error {
 	http.HandleFunc("/", index)
 	http.HandleFunc("/api/stats", stats)
-	return http.ListenAndServe(port, nil)
+	http.HandleFunc("/api/new-senders", newSendersAPI)
+	http.HandleFunc("/api/daily", dailyAPI)
+
+	var (
+		server = &http.Server{Addr: port}
+		served = make(chan error, 1)
+	)
+	go func() {
+		served <- server.ListenAndServe()
+	}()
+
+	select {
+	case err := <-served:
+		return err
+	case <-ctx.Done():
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), viper.GetDuration("shutdownTimeout"))
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		return err
+	}
+	if err := <-served; err != http.ErrServerClosed {
+		return err
+	}
+	return nil
 }
 
 // route for stats api endpoint "/api/stats"
 func stats(w http.ResponseWriter, r *http.Request) {
 	data, err := retrieve("select count(*), sum(records.count), pg_size_pretty(pg_database_size('dmarcdb')) as dbsize from records;")
 	if err != nil {
-		log.Fatal(err)
+		log.Println(err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
 	}
 
 	j, err := json.Marshal(data)
 	if err != nil {
-		log.Fatal(err)
+		log.Println(err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Add("Content-Type", "application/json")
+	fmt.Fprint(w, string(j[:]))
+}
+
+// route for new senders api endpoint "/api/new-senders?since=7d&domain=wvu.edu"
+func newSendersAPI(w http.ResponseWriter, r *http.Request) {
+	since := r.URL.Query().Get("since")
+	if since == "" {
+		since = "7d"
+	}
+	sinceTime, err := parseSince(since)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	senders, err := loadNewSenders(sinceTime, r.URL.Query().Get("domain"))
+	if err != nil {
+		log.Println(err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	j, err := json.Marshal(senders)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Add("Content-Type", "application/json")
+	fmt.Fprint(w, string(j[:]))
+}
+
+// route for daily volumes api endpoint "/api/daily?since=30d&domain=wvu.edu", served from the daily rollup
+func dailyAPI(w http.ResponseWriter, r *http.Request) {
+	since := r.URL.Query().Get("since")
+	if since == "" {
+		since = "30d"
+	}
+	sinceTime, err := parseSince(since)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	counts, err := loadDaily(sinceTime, r.URL.Query().Get("domain"))
+	if err != nil {
+		log.Println(err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	j, err := json.Marshal(counts)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
 	}
 
 	w.Header().Add("Content-Type", "application/json")
@@ -37,9 +127,13 @@ func stats(w http.ResponseWriter, r *http.Request) {
 // route for index "/"
 func index(w http.ResponseWriter, r *http.Request) {
 	tmpl := path.Join(viper.GetString("templates"), "index.html")
-	err := template.Must(template.ParseFiles(tmpl)).Execute(w, nil)
+	t, err := template.ParseFiles(tmpl)
+	if err == nil {
+		err = t.Execute(w, nil)
+	}
 
 	if err != nil {
-		log.Fatal(err)
+		log.Println(err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 	}
 }